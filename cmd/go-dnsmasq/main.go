@@ -45,11 +45,111 @@ func main() {
 		},
 		cli.StringSliceFlag{
 			Name: "nameservers, n", EnvVar: types.NameServers,
-			Usage: "Comma delimited list of `nameservers` <host[:port][,host[:port]]> (supersedes resolv.conf)",
+			Usage: "Comma delimited list of `nameservers` <[tls://]host[:port][#servername], https://host/path[#ip] or sdns://stamp> (supersedes resolv.conf)",
+		},
+		cli.StringSliceFlag{
+			Name: "fallback-nameservers", EnvVar: types.FallbackNameServers,
+			Usage: "Comma delimited list of `nameservers` that are only queried when all of the nameservers fail or answer SERVFAIL",
+		},
+		cli.StringFlag{
+			Name: "shadow-nameserver", EnvVar: types.ShadowNameServer,
+			Usage: "Mirror forwarded queries to this `nameserver` and log answers that differ from those of the nameservers",
+		},
+		cli.IntFlag{
+			Name: "shadow-percent", Value: 100, EnvVar: types.ShadowPercent,
+			Usage: "Share of forwarded queries mirrored to the shadow nameserver in `percent`",
+		},
+		cli.BoolFlag{
+			Name: "recursive", EnvVar: types.Recursive,
+			Usage: "Resolve queries iteratively starting at the root servers instead of forwarding them to nameservers",
+		},
+		cli.StringSliceFlag{
+			Name: "root-hints", EnvVar: types.RootHints,
+			Usage: "Root servers used with '--recursive' <host[:port]> (defaults to the IANA root servers)",
+		},
+		cli.BoolFlag{
+			Name: "dnssec", EnvVar: types.DNSSEC,
+			Usage: "Validate the DNSSEC signatures of forwarded answers",
+		},
+		cli.StringFlag{
+			Name: "trust-anchor-file", EnvVar: types.TrustAnchorFile,
+			Usage: "Zone `file` with the DS or DNSKEY records of the DNSSEC trust anchors (defaults to the root key signing keys)",
+		},
+		cli.BoolFlag{
+			Name: "dns-cookies", EnvVar: types.Cookies,
+			Usage: "Send DNS cookies to nameservers and give server cookies to clients",
+		},
+		cli.BoolFlag{
+			Name: "randomize-case", EnvVar: types.RandomizeCase,
+			Usage: "Randomize the case of query names sent to nameservers over UDP and drop responses that do not echo it",
+		},
+		cli.StringFlag{
+			Name: "tls-ca-file", EnvVar: types.TLSCAFile,
+			Usage: "PEM bundle of CAs used to verify DNS-over-TLS/HTTPS nameservers (defaults to the system roots)",
+		},
+		cli.StringFlag{
+			Name: "doh-method", Value: "POST", EnvVar: types.DoHMethod,
+			Usage: "HTTP `method` used for DNS-over-HTTPS queries (GET or POST)",
+		},
+		cli.StringFlag{
+			Name: "upstream-strategy", Value: server.StrategyStrictOrder, EnvVar: types.UpstreamStrategy,
+			Usage: "How to pick the nameserver to query first (strict-order, round-robin, random, fastest, all-servers)",
+		},
+		cli.StringFlag{
+			Name: "ecs", Value: server.ECSPass, EnvVar: types.ECSMode,
+			Usage: "EDNS Client Subnet handling of forwarded queries (pass, add, strip)",
+		},
+		cli.IntFlag{
+			Name: "ecs-prefix-v4", Value: 24, EnvVar: types.ECSPrefixV4,
+			Usage: "Prefix `length` of IPv4 client subnets added with '--ecs add'",
+		},
+		cli.IntFlag{
+			Name: "ecs-prefix-v6", Value: 56, EnvVar: types.ECSPrefixV6,
+			Usage: "Prefix `length` of IPv6 client subnets added with '--ecs add'",
+		},
+		cli.DurationFlag{
+			Name: "timeout", Value: 4 * time.Second, EnvVar: types.Timeout,
+			Usage: "Timeout of a single attempt to query a nameserver, a query can take '--attempts' times as long unless '--query-deadline' is set",
+		},
+		cli.IntFlag{
+			Name: "attempts", Value: 2, EnvVar: types.Attempts,
+			Usage: "Number of `attempts` made to forward a query",
+		},
+		cli.DurationFlag{
+			Name: "query-deadline", EnvVar: types.QueryDeadline,
+			Usage: "Time a forwarded query may take in total, including search and stub lookups ('0' for no limit)",
 		},
 		cli.StringSliceFlag{
 			Name: "stubzones, z", EnvVar: types.StubZone,
-			Usage: "Use different nameservers for given domains <domain[,domain]/host[:port][,host[:port]]>",
+			Usage: "Use different nameservers for given domains <domain[,domain]/host[:port][,host[:port]]> ('#' for the default nameservers, empty to never forward)",
+		},
+		cli.StringSliceFlag{
+			Name: "rev-server", EnvVar: types.RevServer,
+			Usage: "Send reverse lookups of the addresses in a network to different nameservers <cidr[,host[:port][,host[:port]]]> ('#' for the default nameservers, empty to never forward)",
+		},
+		cli.BoolFlag{
+			Name: "bogus-priv", EnvVar: types.BogusPriv,
+			Usage: "Answer reverse lookups of private addresses that are not found locally or routed with '--rev-server' with NXDOMAIN",
+		},
+		cli.BoolFlag{
+			Name: "stop-dns-rebind", EnvVar: types.StopDNSRebind,
+			Usage: "Answer queries with NXDOMAIN when upstream nameservers resolve them to private addresses",
+		},
+		cli.StringSliceFlag{
+			Name: "rebind-domain-ok", EnvVar: types.RebindDomainOK,
+			Usage: "Allow the `domain` and its subdomains to resolve to private addresses with '--stop-dns-rebind'",
+		},
+		cli.BoolFlag{
+			Name: "dns64", EnvVar: types.DNS64,
+			Usage: "Synthesize AAAA records from the A records of names that have none",
+		},
+		cli.StringFlag{
+			Name: "dns64-prefix", Value: server.DefaultDNS64Prefix, EnvVar: types.DNS64Prefix,
+			Usage: "IPv6 `prefix` the IPv4 addresses are mapped into with '--dns64'",
+		},
+		cli.StringSliceFlag{
+			Name: "dns64-exclude", EnvVar: types.DNS64Exclude,
+			Usage: "Never map IPv4 addresses in the `cidr`, ignore AAAA records in it with '--dns64'",
 		},
 		cli.StringFlag{
 			Name: "hostsfile, f", EnvVar: types.HostsFile,
@@ -81,7 +181,39 @@ func main() {
 		},
 		cli.DurationFlag{
 			Name: "rcache-ttl", Value: time.Minute, EnvVar: types.ResponseCacheTTL,
-			Usage: "TTL for response cache entries",
+			Usage: "TTL for response cache entries without records",
+		},
+		cli.DurationFlag{
+			Name: "rcache-min-ttl", EnvVar: types.ResponseCacheMinTTL,
+			Usage: "Minimum time responses are cached, even if their records have a lower TTL",
+		},
+		cli.DurationFlag{
+			Name: "rcache-max-ttl", Value: 24 * time.Hour, EnvVar: types.ResponseCacheMaxTTL,
+			Usage: "Maximum time responses are cached, even if their records have a higher TTL ('0' for no limit)",
+		},
+		cli.DurationFlag{
+			Name: "neg-cache-ttl", Value: time.Hour, EnvVar: types.NegativeCacheTTL,
+			Usage: "Maximum time NXDOMAIN and NODATA responses are cached, even if their SOA record allows longer ('0' for no limit)",
+		},
+		cli.DurationFlag{
+			Name: "serve-stale", EnvVar: types.ServeStale,
+			Usage: "Answer with cached responses that expired up to this `duration` ago when the nameservers fail ('0' disables it)",
+		},
+		cli.BoolFlag{
+			Name: "prefetch", EnvVar: types.Prefetch,
+			Usage: "Refresh popular cached responses in the background before they expire",
+		},
+		cli.IntFlag{
+			Name: "prefetch-hits", Value: 3, EnvVar: types.PrefetchHits,
+			Usage: "Number of `hits` that make a cached response popular",
+		},
+		cli.IntFlag{
+			Name: "prefetch-percent", Value: 90, EnvVar: types.PrefetchPercent,
+			Usage: "Share of the TTL in `percent` after which popular responses are refreshed",
+		},
+		cli.IntFlag{
+			Name: "prefetch-concurrency", Value: 10, EnvVar: types.PrefetchConcurrency,
+			Usage: "Maximum `number` of responses refreshed at the same time",
 		},
 		cli.BoolFlag{Name: "no-rec", Usage: "Disable recursion", EnvVar: types.DisableRecursion},
 		cli.IntFlag{
@@ -121,6 +253,25 @@ func main() {
 			return err
 		}
 
+		fallbackNameservers, err := server.CreateNameservers(c.StringSlice("fallback-nameservers"))
+		if err != nil {
+			return err
+		}
+
+		var shadowNameserver string
+		if ns := c.String("shadow-nameserver"); ns != "" {
+			shadow, err := server.CreateNameservers([]string{ns})
+			if err != nil {
+				return err
+			}
+			shadowNameserver = shadow[0]
+		}
+
+		rootHints, err := server.CreateNameservers(c.StringSlice("root-hints"))
+		if err != nil {
+			return err
+		}
+
 		searchDomains, err := server.CreateSearchDomains(c.StringSlice("search-domains"))
 		if err != nil {
 			return err
@@ -131,6 +282,11 @@ func main() {
 			return err
 		}
 
+		revmap, err := server.CreateRevServerMap(c.StringSlice("rev-server"))
+		if err != nil {
+			return err
+		}
+
 		listen, err := server.CreateListenAddress(c.String("listen"))
 		if err != nil {
 			return err
@@ -140,6 +296,21 @@ func main() {
 			DnsAddr:             listen,
 			DefaultResolver:     c.Bool("default-resolver"),
 			Nameservers:         nameservers,
+			FallbackNameservers: fallbackNameservers,
+			ShadowNameserver:    shadowNameserver,
+			ShadowPercent:       c.Int("shadow-percent"),
+			Recursive:           c.Bool("recursive"),
+			RootHints:           rootHints,
+			DNSSEC:              c.Bool("dnssec"),
+			TrustAnchorFile:     c.String("trust-anchor-file"),
+			Cookies:             c.Bool("dns-cookies"),
+			RandomizeCase:       c.Bool("randomize-case"),
+			TLSCAFile:           c.String("tls-ca-file"),
+			DoHMethod:           c.String("doh-method"),
+			UpstreamStrategy:    c.String("upstream-strategy"),
+			ECSMode:             c.String("ecs"),
+			ECSPrefixV4:         c.Int("ecs-prefix-v4"),
+			ECSPrefixV6:         c.Int("ecs-prefix-v6"),
 			Systemd:             c.Bool("systemd"),
 			Daemon:              !c.Bool("fg"),
 			SearchDomains:       searchDomains,
@@ -151,11 +322,28 @@ func main() {
 			NoRec:               c.Bool("no-rec"),
 			FwdNdots:            c.Int("fwd-ndots"),
 			Ndots:               c.Int("ndots"),
-			ReadTimeout:         2 * time.Second,
+			ReadTimeout:         c.Duration("timeout"),
+			Attempts:            c.Int("attempts"),
+			QueryDeadline:       c.Duration("query-deadline"),
 			RCache:              c.Int("rcache"),
 			RCacheTtl:           c.Duration("rcache-ttl"),
+			RCacheMinTtl:        c.Duration("rcache-min-ttl"),
+			RCacheMaxTtl:        c.Duration("rcache-max-ttl"),
+			NegCacheTtl:         c.Duration("neg-cache-ttl"),
+			ServeStale:          c.Duration("serve-stale"),
+			Prefetch:            c.Bool("prefetch"),
+			PrefetchHits:        c.Int("prefetch-hits"),
+			PrefetchPercent:     c.Int("prefetch-percent"),
+			PrefetchConcurrency: c.Int("prefetch-concurrency"),
 			Verbose:             c.Bool("verbose"),
 			Stub:                stubmap,
+			RevServers:          revmap,
+			BogusPriv:           c.Bool("bogus-priv"),
+			StopDNSRebind:       c.Bool("stop-dns-rebind"),
+			RebindDomainsOK:     c.StringSlice("rebind-domain-ok"),
+			DNS64:               c.Bool("dns64"),
+			DNS64Prefix:         c.String("dns64-prefix"),
+			DNS64Exclude:        c.StringSlice("dns64-exclude"),
 		}
 
 		if config.Hostsfile == "" {
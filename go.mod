@@ -11,6 +11,7 @@ require (
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
 	github.com/stretchr/testify v1.8.4
 	github.com/urfave/cli v1.22.14
+	golang.org/x/crypto v0.17.0
 	golang.org/x/sync v0.5.0
 )
 
@@ -10,7 +10,9 @@ package cache
 // races. This should be optimized.
 
 import (
+	"container/list"
 	"crypto/sha1"
+	"net"
 	"sync"
 	"time"
 
@@ -20,83 +22,281 @@ import (
 // Elem hold an answer and additional section that returned from the cache.
 // The signature is put in answer, extra is empty there. This wastes some memory.
 type elem struct {
+	key        string
+	added      time.Time
 	expiration time.Time // time added + TTL, after this the elem is invalid
 	msg        *dns.Msg
+	protected  bool // in the protected segment
+
+	hits        int       // since added
+	prefetching bool      // a refresh is due and under way
+	saved       time.Time // expiration a prefetch saved the message from
 }
 
 // Cache is a cache that holds on the a number of RRs or DNS messages. The cache
-// eviction is randomized.
+// eviction is a segmented LRU: new entries start in a probationary segment and
+// move to a protected one when they are hit, so that names in use survive a
+// burst of names looked up only once. Both segments are kept in LRU order.
 type Cache struct {
-	m map[string]*elem
+	m         map[string]*list.Element
+	probation *list.List
+	protected *list.List
 
 	capacity int
-	ttl      time.Duration
-	sync.RWMutex
+	protCap  int           // capacity of the protected segment
+	ttl      time.Duration // for messages without records
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	negTTL   time.Duration
+	stale    time.Duration // how long expired messages are kept
+
+	prefetchHits    int
+	prefetchPercent int
+	sync.Mutex
+}
+
+// now is the clock of the cache, replaced in tests.
+var now = time.Now
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// MinTTL keeps messages at least d in the cache, even if their records
+// have a shorter TTL.
+func MinTTL(d time.Duration) Option {
+	return func(c *Cache) { c.minTTL = d }
+}
+
+// MaxTTL keeps messages at most d in the cache, even if their records have a
+// longer TTL. No limit if 0.
+func MaxTTL(d time.Duration) Option {
+	return func(c *Cache) { c.maxTTL = d }
 }
 
-// New returns a new cache with the capacity and the ttl specified.
-func New(capacity int, ttl time.Duration) *Cache {
+// NegativeTTL keeps NXDOMAIN and NODATA answers at most d in the cache, even
+// if their SOA record allows longer. No limit if 0.
+func NegativeTTL(d time.Duration) Option {
+	return func(c *Cache) { c.negTTL = d }
+}
+
+// Stale keeps messages d after they expired, to be found by StaleKey.
+func Stale(d time.Duration) Option {
+	return func(c *Cache) { c.stale = d }
+}
+
+// New returns a new cache with the capacity specified. Messages expire with
+// the lowest TTL of their answer and authority records, or after ttl if they
+// have none.
+func New(capacity int, ttl time.Duration, opts ...Option) *Cache {
 	c := new(Cache)
-	c.m = make(map[string]*elem)
+	c.m = make(map[string]*list.Element)
+	c.probation = list.New()
+	c.protected = list.New()
 	c.capacity = capacity
+	c.protCap = capacity * 4 / 5
 	c.ttl = ttl
+	for _, opt := range opts {
+		opt(c)
+	}
 	return c
 }
 
+// lifetime returns how long msg may be cached.
+func (c *Cache) lifetime(msg *dns.Msg) time.Duration {
+	if IsNegative(msg) {
+		return c.negativeLifetime(msg)
+	}
+	d := c.ttl
+	if ttl, ok := minTTL(msg); ok {
+		d = time.Duration(ttl) * time.Second
+	}
+	if d < c.minTTL {
+		d = c.minTTL
+	}
+	if c.maxTTL > 0 && d > c.maxTTL {
+		d = c.maxTTL
+	}
+	return d
+}
+
+// negativeLifetime returns how long the negative answer msg may be cached:
+// the lower of the TTL and MINIMUM field of its SOA record (RFC 2308 section
+// 5), or ttl without one. A CNAME chain leading to the answer may expire
+// sooner. MinTTL applies as to other answers, NegativeTTL takes precedence.
+func (c *Cache) negativeLifetime(msg *dns.Msg) time.Duration {
+	d := c.ttl
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			d = time.Duration(ttl) * time.Second
+			break
+		}
+	}
+	for _, rr := range msg.Answer {
+		if chain := time.Duration(rr.Header().Ttl) * time.Second; chain < d {
+			d = chain
+		}
+	}
+	if d < c.minTTL {
+		d = c.minTTL
+	}
+	if c.negTTL > 0 && d > c.negTTL {
+		d = c.negTTL
+	}
+	return d
+}
+
+// IsNegative reports whether msg is a NXDOMAIN or NODATA answer.
+func IsNegative(msg *dns.Msg) bool {
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype != dns.TypeCNAME && rr.Header().Rrtype != dns.TypeRRSIG {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// minTTL returns the lowest TTL of the answer and authority records of msg.
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
 func (c *Cache) Capacity() int { return c.capacity }
 
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.m)
+}
+
 func (c *Cache) Remove(s string) {
 	c.Lock()
-	delete(c.m, s)
+	if el, ok := c.m[s]; ok {
+		c.segment(el).Remove(el)
+		delete(c.m, s)
+	}
 	c.Unlock()
 }
 
-// EvictRandom removes a random member a the cache.
-// Must be called under a write lock.
-func (c *Cache) EvictRandom() {
-	clen := len(c.m)
-	if clen < c.capacity {
-		return
+// segment returns the list of the element el.
+func (c *Cache) segment(el *list.Element) *list.List {
+	if el.Value.(*elem).protected {
+		return c.protected
 	}
-	i := c.capacity - clen
-	for k := range c.m {
-		delete(c.m, k)
-		i--
-		if i == 0 {
-			break
+	return c.probation
+}
+
+// evict removes the least recently used entries of the probationary segment,
+// or of the protected one if it is empty, until the cache fits its capacity.
+// Must be called under a write lock.
+func (c *Cache) evict() {
+	for len(c.m) > c.capacity {
+		l := c.probation
+		if l.Len() == 0 {
+			l = c.protected
 		}
+		el := l.Back()
+		l.Remove(el)
+		delete(c.m, el.Value.(*elem).key)
+		StatsEvictionCount.Inc(1)
 	}
 }
 
-// InsertMessage inserts a message in the Cache. We will cache it for ttl seconds, which
-// should be a small (60...300) integer.
+// InsertMessage inserts a message in the Cache, unless it holds an unexpired one
+// under s. It is cached for the lowest TTL of its records, within the bounds of
+// MinTTL and MaxTTL.
 func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
 	if c.capacity <= 0 {
 		return
 	}
 
+	d := c.lifetime(msg)
+	if d <= 0 {
+		return
+	}
+
 	c.Lock()
-	if _, ok := c.m[s]; !ok {
-		c.m[s] = &elem{time.Now().Add(c.ttl), msg.Copy()}
+	t := now()
+	if el, ok := c.m[s]; !ok {
+		c.m[s] = c.probation.PushFront(&elem{key: s, added: t, expiration: t.Add(d), msg: msg.Copy()})
+		StatsInsertCount.Inc(1)
+	} else if e := el.Value.(*elem); !t.Before(e.expiration) {
+		// a stale message is replaced
+		e.replace(t, d, msg)
+		StatsInsertCount.Inc(1)
 	}
-	c.EvictRandom()
+	c.evict()
 	c.Unlock()
 }
 
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
 // in the cache.
 func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
+	m, _, exp, ok := c.search(s, false)
+	return m, exp, ok
+}
+
+// search is like Search and also returns when the message was added. With
+// count, a hit of an unexpired message is counted.
+func (c *Cache) search(s string, count bool) (*dns.Msg, time.Time, time.Time, bool) {
 	if c.capacity <= 0 {
-		return nil, time.Time{}, false
+		return nil, time.Time{}, time.Time{}, false
+	}
+	c.Lock()
+	el, ok := c.m[s]
+	if !ok {
+		c.Unlock()
+		return nil, time.Time{}, time.Time{}, false
+	}
+	e := el.Value.(*elem)
+	if e.protected {
+		c.protected.MoveToFront(el)
+	} else {
+		c.promote(el)
 	}
-	c.RLock()
-	if e, ok := c.m[s]; ok {
-		e1 := e.msg.Copy()
-		c.RUnlock()
-		return e1, e.expiration, true
+	if count {
+		e.hit(now())
+	}
+	e1, added, exp := e.msg.Copy(), e.added, e.expiration
+	c.Unlock()
+	return e1, added, exp, true
+}
+
+// promote moves el from the probationary to the protected segment. If that
+// is full, its least recently used entry goes back to probation.
+// Must be called under a write lock.
+func (c *Cache) promote(el *list.Element) {
+	e := el.Value.(*elem)
+	c.probation.Remove(el)
+	e.protected = true
+	c.m[e.key] = c.protected.PushFront(e)
+	if c.protected.Len() > c.protCap {
+		last := c.protected.Back()
+		c.protected.Remove(last)
+		l := last.Value.(*elem)
+		l.protected = false
+		c.m[l.key] = c.probation.PushFront(l)
 	}
-	c.RUnlock()
-	return nil, time.Time{}, false
 }
 
 // Key creates a hash key from a question section. It creates a different key
@@ -113,6 +313,24 @@ func Key(q dns.Question, dnssec, tcp bool) string {
 	return string(h.Sum(i))
 }
 
+// KeySubnet extends a key created by Key with a client subnet, for answers
+// that are only valid for clients in the subnet ip/prefix (RFC 7871). With
+// a prefix of zero the answer is valid for any client that sent a subnet.
+func KeySubnet(key string, ip net.IP, prefix uint8) string {
+	i := append([]byte(key), 253, prefix)
+	if prefix > 0 {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		if int(prefix) > bits {
+			prefix = uint8(bits)
+		}
+		i = append(i, ip.Mask(net.CIDRMask(int(prefix), bits))...)
+	}
+	return string(i)
+}
+
 // Key uses the name, type and rdata, which is serialized and then hashed as the key for the lookup.
 func KeyRRset(rrs []dns.RR) string {
 	h := sha1.New()
@@ -5,6 +5,8 @@
 package cache
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -80,3 +82,269 @@ func TestExpireMessage(t *testing.T) {
 		t.Fatalf("bad Qtype, expected nil, got %d:", m1.Question[0].Qtype)
 	}
 }
+
+func TestEvictLRU(t *testing.T) {
+	c := New(5, time.Minute)
+	for _, name := range []string{"a.", "b.", "c.", "d.", "e."} {
+		c.InsertMessage(name, newMsg(name, dns.TypeA))
+	}
+	// a is used again, so b is the least recently used entry.
+	if _, _, ok := c.Search("a."); !ok {
+		t.Fatal("a. not found")
+	}
+	c.InsertMessage("f.", newMsg("f.", dns.TypeA))
+	if c.Len() != 5 {
+		t.Fatalf("bad length, expected 5, got %d", c.Len())
+	}
+	for name, want := range map[string]bool{"a.": true, "b.": false, "c.": true, "f.": true} {
+		if _, _, ok := c.Search(name); ok != want {
+			t.Fatalf("bad search result for %s, expected %t, got %t", name, want, ok)
+		}
+	}
+}
+
+func TestEvictScan(t *testing.T) {
+	c := New(10, time.Minute)
+	hot := []string{"a.", "b.", "c.", "d."}
+	for _, name := range hot {
+		c.InsertMessage(name, newMsg(name, dns.TypeA))
+		c.Search(name)
+	}
+	// A burst of names looked up only once does not push out names in use.
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("once%d.", i)
+		c.InsertMessage(name, newMsg(name, dns.TypeA))
+	}
+	for _, name := range hot {
+		if _, _, ok := c.Search(name); !ok {
+			t.Fatalf("%s was evicted", name)
+		}
+	}
+	if c.Len() != 10 {
+		t.Fatalf("bad length, expected 10, got %d", c.Len())
+	}
+
+	c.Remove("a.")
+	if _, _, ok := c.Search("a."); ok || c.Len() != 9 {
+		t.Fatal("a. was not removed")
+	}
+}
+
+const benchEntries = 100000
+
+func benchKeys(n int) ([]string, *dns.Msg) {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = Key(dns.Question{Name: fmt.Sprintf("host%d.example.com.", i), Qtype: dns.TypeA}, false, false)
+	}
+	m := newMsg("host.example.com.", dns.TypeA)
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "host.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}}}
+	return keys, m
+}
+
+func BenchmarkInsertMessage(b *testing.B) {
+	// Twice as many names as fit, so that every insert evicts in the end.
+	keys, m := benchKeys(2 * benchEntries)
+	c := New(benchEntries, time.Minute)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.InsertMessage(keys[i%len(keys)], m)
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	keys, m := benchKeys(benchEntries)
+	c := New(benchEntries, time.Minute)
+	for _, key := range keys {
+		c.InsertMessage(key, m)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Search(keys[i%len(keys)])
+	}
+}
+
+// BenchmarkHitRatio looks up names of a Zipf distribution, the way a few
+// names make up most of the queries, among one-off names 10 times the size
+// of the cache.
+func BenchmarkHitRatio(b *testing.B) {
+	keys, m := benchKeys(10 * benchEntries)
+	c := New(benchEntries, time.Minute)
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.01, 1, uint64(len(keys)-1))
+	hits := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[zipf.Uint64()]
+		if _, _, ok := c.Search(key); ok {
+			hits++
+		} else {
+			c.InsertMessage(key, m)
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+}
+
+func TestRecordTTL(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return clock }
+
+	msg := func(name string, ttls ...uint32) *dns.Msg {
+		m := newMsg(name, dns.TypeA)
+		for _, ttl := range ttls {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}})
+		}
+		m.SetEdns0(4096, true)
+		return m
+	}
+	c := New(10, time.Minute, MinTTL(10*time.Second), MaxTTL(time.Hour))
+	tests := []struct {
+		m    *dns.Msg
+		want time.Duration
+	}{
+		{m: msg("short.", 300, 20), want: 20 * time.Second},
+		{m: msg("min.", 5), want: 10 * time.Second},
+		{m: msg("max.", 86400), want: time.Hour},
+		{m: msg("norecords."), want: time.Minute},
+	}
+	for _, tc := range tests {
+		key := Key(tc.m.Question[0], false, false)
+		c.InsertMessage(key, tc.m)
+		_, exp, ok := c.Search(key)
+		if !ok || exp.Sub(clock) != tc.want {
+			t.Fatalf("bad expiration of %s, expected %s, got %s", tc.m.Question[0].Name, tc.want, exp.Sub(clock))
+		}
+	}
+
+	// The TTLs count down while the message is cached, records kept longer
+	// than their TTL go down to 0.
+	clock = clock.Add(8 * time.Second)
+	if m := c.Hit(dns.Question{Name: "min.", Qtype: dns.TypeA}, false, false, 1); m == nil || m.Answer[0].Header().Ttl != 0 {
+		t.Fatalf("bad TTL, expected 0, got %v", m)
+	}
+	q := dns.Question{Name: "short.", Qtype: dns.TypeA}
+	clock = clock.Add(7 * time.Second)
+	m := c.Hit(q, false, false, 1)
+	if m == nil || m.Answer[0].Header().Ttl != 285 || m.Answer[1].Header().Ttl != 5 {
+		t.Fatalf("bad TTLs, expected 285 and 5, got %v", m)
+	}
+	if !m.IsEdns0().Do() {
+		t.Fatal("the flags of the OPT record changed")
+	}
+	clock = clock.Add(5 * time.Second)
+	if m := c.Hit(q, false, false, 1); m != nil {
+		t.Fatalf("bad cache hit, expected <nil>, got %s", m)
+	}
+
+	// Messages with a TTL of 0 are not cached.
+	c = New(10, time.Minute)
+	c.InsertMessage("zero.", msg("zero.", 0))
+	if c.Len() != 0 {
+		t.Fatal("message with TTL 0 was cached")
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return clock }
+
+	negative := func(name string, rcode int, soa string, answer ...string) *dns.Msg {
+		m := newMsg(name, dns.TypeAAAA)
+		m.Rcode = rcode
+		for _, rr := range answer {
+			a, _ := dns.NewRR(rr)
+			m.Answer = append(m.Answer, a)
+		}
+		if soa != "" {
+			rr, _ := dns.NewRR(soa)
+			m.Ns = append(m.Ns, rr)
+		}
+		return m
+	}
+	const soa = "example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 1800 900 604800 %d"
+	c := New(10, time.Minute, MinTTL(10*time.Second), MaxTTL(time.Hour), NegativeTTL(10*time.Minute))
+	tests := []struct {
+		m    *dns.Msg
+		want time.Duration
+	}{
+		{m: negative("nxdomain.example.com.", dns.RcodeNameError, fmt.Sprintf(soa, 300)), want: 5 * time.Minute},
+		{m: negative("nodata.example.com.", dns.RcodeSuccess, fmt.Sprintf(soa, 86400)), want: 10 * time.Minute},
+		{m: negative("alias.example.com.", dns.RcodeNameError, fmt.Sprintf(soa, 300),
+			"alias.example.com. 30 IN CNAME nxdomain.example.com."), want: 30 * time.Second},
+		{m: negative("nosoa.example.com.", dns.RcodeSuccess, ""), want: time.Minute},
+		{m: negative("short.example.com.", dns.RcodeNameError, fmt.Sprintf(soa, 5)), want: 10 * time.Second},
+	}
+	for _, tc := range tests {
+		if !IsNegative(tc.m) {
+			t.Fatalf("%s is not negative", tc.m.Question[0].Name)
+		}
+		key := Key(tc.m.Question[0], false, false)
+		c.InsertMessage(key, tc.m)
+		_, exp, ok := c.Search(key)
+		if !ok || exp.Sub(clock) != tc.want {
+			t.Fatalf("bad expiration of %s, expected %s, got %s", tc.m.Question[0].Name, tc.want, exp.Sub(clock))
+		}
+	}
+
+	// The SOA record stays in the answer and counts down.
+	clock = clock.Add(time.Minute)
+	m := c.Hit(dns.Question{Name: "nxdomain.example.com.", Qtype: dns.TypeAAAA}, false, false, 1)
+	if m == nil || len(m.Ns) != 1 || m.Ns[0].Header().Ttl != 3540 {
+		t.Fatalf("bad cached negative answer %v", m)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return clock }
+
+	m := newMsg("popular.", dns.TypeA)
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "popular.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}}}
+	q := m.Question[0]
+	key := Key(q, false, false)
+	c := New(10, time.Minute, Prefetch(2, 90))
+	c.InsertMessage(key, m)
+
+	c.Hit(q, false, false, 1)
+	clock = clock.Add(90 * time.Second)
+	if c.Due(key) {
+		t.Fatal("message hit once is due")
+	}
+	c.Hit(q, false, false, 1)
+	if !c.Due(key) {
+		t.Fatal("popular message is not due")
+	}
+	if c.Due(key) {
+		t.Fatal("message is due twice")
+	}
+
+	// A failed prefetch may be tried again.
+	c.PrefetchFailed(key)
+	if !c.Due(key) {
+		t.Fatal("message is not due after a failed prefetch")
+	}
+
+	// The refreshed message is served past the old expiration.
+	c.RefreshMessage(key, m)
+	clock = clock.Add(20 * time.Second)
+	if m := c.Hit(q, false, false, 1); m == nil || m.Answer[0].Header().Ttl != 80 {
+		t.Fatalf("bad prefetched message %v", m)
+	}
+	if c.Due(key) {
+		t.Fatal("refreshed message is due before it got popular again")
+	}
+
+	c = New(10, time.Minute)
+	c.InsertMessage(key, m)
+	for i := 0; i < 3; i++ {
+		c.Hit(q, false, false, 1)
+	}
+	clock = clock.Add(99 * time.Second)
+	if c.Due(key) {
+		t.Fatal("message is due without prefetching")
+	}
+}
@@ -11,21 +11,74 @@ import (
 )
 
 // Hit returns a dns message from the cache. If the message's TTL is expired nil
-// is returned and the message is removed from the cache.
+// is returned and the message is removed from the cache, unless it may still
+// be served stale.
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) *dns.Msg {
-	key := Key(question, dnssec, tcp)
-	m1, exp, hit := c.Search(key)
+	return c.HitKey(Key(question, dnssec, tcp), msgid)
+}
+
+// HitKey is like Hit for a message stored under key. The TTLs of its records
+// are reduced by the time it spent in the cache.
+func (c *Cache) HitKey(key string, msgid uint16) *dns.Msg {
+	m1, added, exp, hit := c.search(key, true)
 	if hit {
 		// Cache hit! \o/
-		if time.Since(exp) < 0 {
+		t := now()
+		if t.Before(exp) {
 			m1.Id = msgid
 			m1.Compress = true
 			// Even if something ended up with the TC bit *in* the cache, set it to off
 			m1.Truncated = false
+			age(m1, uint32(t.Sub(added)/time.Second))
 			return m1
 		}
 		// Expired! /o\
-		c.Remove(key)
+		if !t.Before(exp.Add(c.stale)) {
+			c.Remove(key)
+		}
 	}
 	return nil
 }
+
+// StaleKey returns the message stored under key if it expired less than the
+// Stale duration ago (RFC 8767), with the TTLs of its records set to ttl.
+func (c *Cache) StaleKey(key string, msgid uint16, ttl uint32) *dns.Msg {
+	m1, _, exp, hit := c.search(key, false)
+	if !hit {
+		return nil
+	}
+	if t := now(); t.Before(exp) || !t.Before(exp.Add(c.stale)) {
+		return nil
+	}
+	m1.Id = msgid
+	m1.Compress = true
+	m1.Truncated = false
+	for _, section := range [][]dns.RR{m1.Answer, m1.Ns, m1.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	return m1
+}
+
+// age reduces the TTLs of the records of m by seconds, down to 0.
+func age(m *dns.Msg, seconds uint32) {
+	if seconds == 0 {
+		return
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == dns.TypeOPT:
+				// the TTL field holds flags
+			case hdr.Ttl > seconds:
+				hdr.Ttl -= seconds
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Prefetch makes Due report messages that were hit at least hits times once
+// percent of their lifetime passed.
+func Prefetch(hits, percent int) Option {
+	return func(c *Cache) { c.prefetchHits, c.prefetchPercent = hits, percent }
+}
+
+// Due reports whether the message stored under key is popular and close
+// enough to its expiration to be refreshed. It reports each message once,
+// until it is refreshed with RefreshMessage or PrefetchFailed is called.
+func (c *Cache) Due(key string) bool {
+	if c.prefetchPercent <= 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.m[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*elem)
+	t := now()
+	lifetime := e.expiration.Sub(e.added)
+	if e.prefetching || e.hits < c.prefetchHits || !t.Before(e.expiration) ||
+		t.Sub(e.added) < lifetime*time.Duration(c.prefetchPercent)/100 {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// RefreshMessage replaces the message stored under key with msg, fetched
+// because Due reported it.
+func (c *Cache) RefreshMessage(key string, msg *dns.Msg) {
+	d := c.lifetime(msg)
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.m[key]
+	if !ok {
+		return
+	}
+	e := el.Value.(*elem)
+	t := now()
+	if d <= 0 || !t.Before(e.expiration) {
+		// too late to save a miss
+		e.prefetching = false
+		return
+	}
+	saved := e.expiration
+	e.replace(t, d, msg)
+	e.saved = saved
+}
+
+// PrefetchFailed makes the message stored under key due again, after the
+// prefetch Due reported it for failed.
+func (c *Cache) PrefetchFailed(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.m[key]; ok {
+		el.Value.(*elem).prefetching = false
+	}
+}
+
+// replace stores msg in e for d from t.
+func (e *elem) replace(t time.Time, d time.Duration, msg *dns.Msg) {
+	e.added, e.expiration, e.msg = t, t.Add(d), msg.Copy()
+	e.hits, e.prefetching, e.saved = 0, false, time.Time{}
+}
+
+// hit counts a hit of e at t. The first one after the expiration a prefetch
+// saved it from would have been a miss.
+func (e *elem) hit(t time.Time) {
+	if !t.Before(e.expiration) {
+		return
+	}
+	e.hits++
+	if !e.saved.IsZero() && !t.Before(e.saved) {
+		StatsPrefetchHitCount.Inc(1)
+		e.saved = time.Time{}
+	}
+}
@@ -0,0 +1,18 @@
+package cache
+
+// Counter is the metric interface used by this package
+type Counter interface {
+	Inc(i int64)
+}
+
+type nopCounter struct{}
+
+func (nopCounter) Inc(_ int64) {}
+
+var (
+	StatsInsertCount   Counter = nopCounter{}
+	StatsEvictionCount Counter = nopCounter{}
+
+	// Hits of prefetched messages that would have expired without
+	StatsPrefetchHitCount Counter = nopCounter{}
+)
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var errCaseMismatch = errors.New("response does not echo the case of the query name")
+
+// randomizeCase returns a copy of req with the letters of its query name in
+// random case (draft-vixie-dnsext-dns0x20). A spoofed response has to guess
+// them in addition to the message ID and port.
+func randomizeCase(req *dns.Msg) *dns.Msg {
+	name := []byte(req.Question[0].Name)
+	bits := make([]byte, (len(name)+7)/8)
+	rand.Read(bits)
+	for i, c := range name {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			if bits[i/8]&(1<<(i%8)) != 0 {
+				name[i] = c ^ 0x20
+			}
+		}
+	}
+	up := req.Copy()
+	up.Question[0].Name = string(name)
+	return up
+}
+
+// restoreCase checks that r echoes the query name of up exactly and gives
+// r, and any records owned by that name, the spelling of the client in req.
+func restoreCase(req, up, r *dns.Msg) error {
+	sent := up.Question[0].Name
+	if len(r.Question) != 1 || r.Question[0].Name != sent {
+		StatsCaseMismatchCount.Inc(1)
+		return errCaseMismatch
+	}
+	name := req.Question[0].Name
+	r.Question[0].Name = name
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, sent) {
+				rr.Header().Name = name
+			}
+		}
+	}
+	return nil
+}
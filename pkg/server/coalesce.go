@@ -0,0 +1,56 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// inflightKey returns the key under which identical queries are forwarded
+// only once. The name is used as is, so every waiter gets its own spelling
+// of the question back. Queries for different client subnets differ too.
+func inflightKey(req *dns.Msg, tcp bool) string {
+	q := req.Question[0]
+	var b strings.Builder
+	b.WriteString(q.Name)
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	if o := req.IsEdns0(); o != nil {
+		if o.Do() {
+			b.WriteString("/do")
+		}
+		if e := findSubnet(o); e != nil {
+			b.WriteString("/ecs=")
+			b.WriteString(e.Address.String())
+			b.WriteByte('/')
+			b.WriteString(strconv.Itoa(int(e.SourceNetmask)))
+		}
+	}
+	if req.CheckingDisabled {
+		b.WriteString("/cd")
+	}
+	if tcp {
+		b.WriteString("/tcp")
+	}
+	return b.String()
+}
+
+// coalesce runs forward for req unless an identical query is already being
+// forwarded, in which case it waits for and shares that answer. Shared
+// answers are copied and carry the message ID of req.
+func (s *Server) coalesce(req *dns.Msg, tcp bool, forward func() *dns.Msg) *dns.Msg {
+	v, _, shared := s.inflight.Do(inflightKey(req, tcp), func() (interface{}, error) {
+		return forward(), nil
+	})
+	m := v.(*dns.Msg)
+	if !shared {
+		return m
+	}
+	StatsCoalescedCount.Inc(1)
+	m = m.Copy()
+	m.Id = req.Id
+	return m
+}
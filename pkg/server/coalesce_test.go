@@ -0,0 +1,53 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesceForwardedQueries(t *testing.T) {
+	var requests int32
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		answerA("10.0.0.9")(w, req)
+	}))
+	s := New(nil, &Config{Nameservers: []string{upstream}, Ndots: 1, ReadTimeout: time.Second}, "", nil)
+
+	const clients = 10
+	replies := make([]*dns.Msg, clients)
+	reqs := make([]*dns.Msg, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		reqs[i] = new(dns.Msg)
+		reqs[i].SetQuestion("example.com.", dns.TypeA)
+		reqs[i].Id = uint16(1000 + i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i] = s.ServeDNSForward(NewWriter("udp", "127.0.0.1:0"), reqs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	for i, m := range replies {
+		assert.Equal(t, reqs[i].Id, m.Id)
+		if assert.Len(t, m.Answer, 1) {
+			assert.Equal(t, "10.0.0.9", m.Answer[0].(*dns.A).A.String())
+		}
+	}
+
+	// A query with the DO bit set is not answered with the others.
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	other := req.Copy()
+	other.SetEdns0(4096, true)
+	assert.NotEqual(t, inflightKey(req, false), inflightKey(other, false))
+	assert.NotEqual(t, inflightKey(req, false), inflightKey(req, true))
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -17,8 +19,15 @@ import (
 
 // Config provides options to the go-dnsmasq resolver
 type Config struct {
-	// Stub zones support. Map contains domainname -> nameserver:port
+	// Stub zones support. Map contains domainname -> nameserver:port.
+	// The most specific zone of a name wins, see CreateStubMap for exceptions.
 	Stub map[string][]string
+	// Reverse zones generated from CIDR rules, see CreateRevServerMap.
+	// Stub zones take precedence over them.
+	RevServers map[string][]string
+	// Answer reverse lookups of private addresses that are neither found
+	// locally nor routed to a nameserver with NXDOMAIN.
+	BogusPriv bool `json:"bogus_priv,omitempty"`
 	// The ip:port go-dnsmasq should be listening on for incoming DNS requests.
 	DnsAddr string `json:"dns_addr,omitempty"`
 	// Path to the hostfile
@@ -28,14 +37,95 @@ type Config struct {
 	// Search domains used to qualify queries
 	SearchDomains []string `json:"search_domains,omitempty"`
 	// List of ip:port, seperated by commas of recursive nameservers to forward queries to.
+	// DNS-over-TLS nameservers are written as tls://ip:port#servername,
+	// DNS-over-HTTPS nameservers as https://host/dns-query#bootstrap-ip.
 	Nameservers []string `json:"nameservers,omitempty"`
+	// Nameservers that are only queried when all of Nameservers failed or
+	// answered SERVFAIL. Written like Nameservers.
+	FallbackNameservers []string `json:"fallback_nameservers,omitempty"`
+	// Nameserver that is sent a copy of forwarded queries to compare its
+	// answers with those of Nameservers. Its answers never reach clients.
+	ShadowNameserver string `json:"shadow_nameserver,omitempty"`
+	// Share of forwarded queries mirrored to ShadowNameserver in percent. Defaults to 100.
+	ShadowPercent int `json:"shadow_percent,omitempty"`
+	// Resolve queries iteratively starting at the root servers instead of
+	// forwarding them to Nameservers. Stub zones are still forwarded.
+	Recursive bool `json:"recursive,omitempty"`
+	// ip:port of the root servers used in recursive mode. Defaults to DefaultRootHints.
+	RootHints []string `json:"root_hints,omitempty"`
+	// Send DNS cookies (RFC 7873) to plain DNS nameservers and give server
+	// cookies to UDP clients that send a client cookie.
+	Cookies bool `json:"cookies,omitempty"`
+	// Called for each UDP query with the outcome of checking its cookie.
+	// Limited queries get an empty truncated reply so that the client
+	// retries over TCP.
+	RateLimit RateLimitFunc `json:"-"`
+	// Randomize the case of the query name sent to plain DNS nameservers over
+	// UDP and drop responses that do not echo it.
+	RandomizeCase bool `json:"randomize_case,omitempty"`
+	// Synthesize AAAA records from A records for names without any (RFC 6147).
+	DNS64 bool `json:"dns64,omitempty"`
+	// IPv6 prefix the IPv4 addresses are mapped into. Defaults to DefaultDNS64Prefix.
+	DNS64Prefix string `json:"dns64_prefix,omitempty"`
+	// Networks of A records that are never mapped and AAAA records that are
+	// ignored, so that the name is mapped as if it had none.
+	DNS64Exclude []string `json:"dns64_exclude,omitempty"`
+	// Validate the DNSSEC signatures of forwarded answers.
+	DNSSEC bool `json:"dnssec,omitempty"`
+	// Path to a file with the DS or DNSKEY records of the trust anchors in
+	// zone file syntax. Defaults to the root key signing keys.
+	TrustAnchorFile string `json:"trust_anchor_file,omitempty"`
+	// Turn answers that resolve names to private addresses into NXDOMAIN,
+	// except for the names in RebindDomainsOK and their subdomains and the
+	// names in stub zones.
+	StopDNSRebind   bool     `json:"stop_dns_rebind,omitempty"`
+	RebindDomainsOK []string `json:"rebind_domains_ok,omitempty"`
+	// Path to a PEM bundle of CAs used to verify DNS-over-TLS/HTTPS nameservers.
+	// The system roots are used when empty.
+	TLSCAFile string `json:"tls_ca_file,omitempty"`
+	// HTTP method used for DNS-over-HTTPS queries, GET or POST. Defaults to POST.
+	DoHMethod string `json:"doh_method,omitempty"`
+	// How to pick the nameserver a query is sent to first. Defaults to strict-order.
+	UpstreamStrategy string `json:"upstream_strategy,omitempty"`
+	// EDNS Client Subnet handling of forwarded queries: pass, add or strip. Defaults to pass.
+	ECSMode string `json:"ecs_mode,omitempty"`
+	// Prefix lengths of the client subnets added in ECS add mode. Default to 24 and 56.
+	ECSPrefixV4 int `json:"ecs_prefix_v4,omitempty"`
+	ECSPrefixV6 int `json:"ecs_prefix_v6,omitempty"`
 	// Hostfile Polling
 	PollInterval time.Duration `json:"poll_interval,omitempty"`
-	ReadTimeout  time.Duration `json:"read_timeout,omitempty"`
+	// Timeout of a single attempt to query a nameserver, not of the whole
+	// query: a forwarded query can take Attempts times as long, and longer
+	// with search domains or fallback nameservers, unless QueryDeadline is
+	// set. Defaults to 4s.
+	ReadTimeout time.Duration `json:"read_timeout,omitempty"`
+	// Number of attempts made to forward a query. Defaults to 2.
+	Attempts int `json:"attempts,omitempty"`
+	// Time a forwarded query may take in total, including the search and
+	// stub lookups. No limit if 0.
+	QueryDeadline time.Duration `json:"query_deadline,omitempty"`
 	// RCache, capacity of response cache in resource records stored.
 	RCache int `json:"rcache,omitempty"`
-	// RCacheTtl, how long to cache in seconds.
+	// RCacheTtl, how long to cache responses without records, e.g. SERVFAIL.
+	// Other responses are cached for the lowest TTL of their records.
 	RCacheTtl time.Duration `json:"rcache_ttl,omitempty"`
+	// Bounds of the time responses are cached. No upper bound if RCacheMaxTtl is 0.
+	RCacheMinTtl time.Duration `json:"rcache_min_ttl,omitempty"`
+	RCacheMaxTtl time.Duration `json:"rcache_max_ttl,omitempty"`
+	// NXDOMAIN and NODATA responses are cached for the TTL of their SOA
+	// record (RFC 2308), at least RCacheMinTtl and at most NegCacheTtl. No
+	// limit if 0.
+	NegCacheTtl time.Duration `json:"neg_cache_ttl,omitempty"`
+	// Answer with cached responses that expired at most ServeStale ago when
+	// the nameservers fail or take longer than 1.8s (RFC 8767). Disabled if 0.
+	ServeStale time.Duration `json:"serve_stale,omitempty"`
+	// Refresh cached responses hit at least PrefetchHits times in the background
+	// once PrefetchPercent of their TTL passed, at most PrefetchConcurrency at a
+	// time. Default to 3, 90 and 10.
+	Prefetch            bool `json:"prefetch,omitempty"`
+	PrefetchHits        int  `json:"prefetch_hits,omitempty"`
+	PrefetchPercent     int  `json:"prefetch_percent,omitempty"`
+	PrefetchConcurrency int  `json:"prefetch_concurrency,omitempty"`
 	// How many dots a name must have before we allow to forward the query as-is. Defaults to 1.
 	FwdNdots int `json:"fwd_ndots,omitempty"`
 	// How many dots a name must have before we do an initial absolute query. Defaults to 1.
@@ -93,9 +183,12 @@ func CheckConfig(config *Config) error {
 	if config.DnsAddr == "" {
 		return fmt.Errorf("'listen' cannot be empty")
 	}
-	if !config.NoRec && len(config.Nameservers) == 0 {
+	if !config.NoRec && len(config.Nameservers) == 0 && !config.Recursive {
 		return fmt.Errorf("recursion is enabled but no nameservers are configured")
 	}
+	if config.Recursive && len(config.RootHints) == 0 {
+		config.RootHints = DefaultRootHints
+	}
 
 	if config.EnableSearch && len(config.SearchDomains) == 0 {
 		config.EnableSearch = false
@@ -107,6 +200,110 @@ func CheckConfig(config *Config) error {
 	if config.RCacheTtl <= 0 {
 		return fmt.Errorf("'rcache-ttl' must be greater than 0")
 	}
+	if config.NegCacheTtl < 0 {
+		return fmt.Errorf("'neg-cache-ttl' must be equal or greater than 0")
+	}
+	if config.ServeStale < 0 {
+		return fmt.Errorf("'serve-stale' must be equal or greater than 0")
+	}
+	if config.PrefetchHits == 0 {
+		config.PrefetchHits = 3
+	}
+	if config.PrefetchPercent == 0 {
+		config.PrefetchPercent = 90
+	}
+	if config.PrefetchConcurrency == 0 {
+		config.PrefetchConcurrency = 10
+	}
+	if config.PrefetchHits < 0 {
+		return fmt.Errorf("'prefetch-hits' must be greater than 0")
+	}
+	if config.PrefetchPercent < 0 || config.PrefetchPercent > 100 {
+		return fmt.Errorf("'prefetch-percent' must be between 1 and 100")
+	}
+	if config.PrefetchConcurrency < 0 {
+		return fmt.Errorf("'prefetch-concurrency' must be greater than 0")
+	}
+	if config.RCacheMinTtl < 0 {
+		return fmt.Errorf("'rcache-min-ttl' must be equal or greater than 0")
+	}
+	if config.RCacheMaxTtl < 0 || config.RCacheMaxTtl > 0 && config.RCacheMaxTtl < config.RCacheMinTtl {
+		return fmt.Errorf("'rcache-max-ttl' must be 0 or greater than 'rcache-min-ttl'")
+	}
+	if config.ShadowPercent == 0 {
+		config.ShadowPercent = 100
+	}
+	if config.ShadowPercent < 0 || config.ShadowPercent > 100 {
+		return fmt.Errorf("'shadow-percent' must be between 1 and 100")
+	}
+	if config.TLSCAFile != "" {
+		if _, err := loadRootCAs(config.TLSCAFile); err != nil {
+			return fmt.Errorf("'tls-ca-file': %s", err)
+		}
+	}
+	for _, domain := range config.RebindDomainsOK {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return fmt.Errorf("'rebind-domain-ok' is not a domain name: %s", domain)
+		}
+	}
+	if config.DNS64 {
+		if _, err := newDNS64(config.DNS64Prefix, config.DNS64Exclude); err != nil {
+			return fmt.Errorf("'dns64-prefix' or 'dns64-exclude': %s", err)
+		}
+	}
+	if config.DNSSEC {
+		if _, err := loadTrustAnchors(config.TrustAnchorFile); err != nil {
+			return fmt.Errorf("'trust-anchor-file': %s", err)
+		}
+	}
+	switch config.DoHMethod {
+	case "":
+		config.DoHMethod = http.MethodPost
+	case http.MethodGet, http.MethodPost:
+	default:
+		return fmt.Errorf("'doh-method' must be GET or POST")
+	}
+	switch config.UpstreamStrategy {
+	case "":
+		config.UpstreamStrategy = StrategyStrictOrder
+	case StrategyStrictOrder, StrategyRoundRobin, StrategyRandom, StrategyFastest, StrategyAllServers:
+	default:
+		return fmt.Errorf("'upstream-strategy' must be one of %s", strings.Join(upstreamStrategies, ", "))
+	}
+	switch config.ECSMode {
+	case "":
+		config.ECSMode = ECSPass
+	case ECSPass, ECSAdd, ECSStrip:
+	default:
+		return fmt.Errorf("'ecs' must be one of pass, add, strip")
+	}
+	if config.ECSPrefixV4 == 0 {
+		config.ECSPrefixV4 = 24
+	}
+	if config.ECSPrefixV6 == 0 {
+		config.ECSPrefixV6 = 56
+	}
+	if config.ECSPrefixV4 < 0 || config.ECSPrefixV4 > 32 {
+		return fmt.Errorf("'ecs-prefix-v4' must be between 0 and 32")
+	}
+	if config.ECSPrefixV6 < 0 || config.ECSPrefixV6 > 128 {
+		return fmt.Errorf("'ecs-prefix-v6' must be between 0 and 128")
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = 4 * time.Second
+	}
+	if config.ReadTimeout < 0 {
+		return fmt.Errorf("'timeout' must be greater than 0")
+	}
+	if config.Attempts == 0 {
+		config.Attempts = defaultAttempts
+	}
+	if config.Attempts < 0 {
+		return fmt.Errorf("'attempts' must be greater than 0")
+	}
+	if config.QueryDeadline < 0 {
+		return fmt.Errorf("'query-deadline' must be equal or greater than 0")
+	}
 	if config.Ndots < 0 {
 		return fmt.Errorf("'ndots' must be greater than 0")
 	}
@@ -154,52 +351,62 @@ func CreateSearchDomains(domains []string) ([]string, error) {
 
 func CreateNameservers(servers []string) ([]string, error) {
 	nameservers := []string{}
-	for _, hostPort := range servers {
-		hostPort = strings.TrimSpace(hostPort)
-		if strings.HasSuffix(hostPort, "]") {
-			hostPort += ":53"
-		} else if !strings.Contains(hostPort, ":") {
-			hostPort += ":53"
-		}
-		if err := validateHostPort(hostPort); err != nil {
+	for _, ns := range servers {
+		ns, err := createNameserver(ns)
+		if err != nil {
 			return nil, fmt.Errorf("nameserver is invalid: %s", err)
 		}
-		nameservers = append(nameservers, hostPort)
+		nameservers = append(nameservers, ns)
 	}
 	return nameservers, nil
 }
 
+// CreateStubMap parses stub zones written as domain[,domain]/host[:port][,host[:port]].
+// A leading slash is accepted, so that dnsmasq's /domain/host syntax works too.
+// A zone with the nameserver StubDefault ('#') is forwarded to the default
+// nameservers and a zone without nameservers is never forwarded.
 func CreateStubMap(stubzones []string) (map[string][]string, error) {
 	if len(stubzones) == 0 {
 		return nil, nil
 	}
 	stubmap := make(map[string][]string)
 	for _, stubzone := range stubzones {
-		segments := strings.Split(stubzone, "/")
-		if len(segments) != 2 || len(segments[0]) == 0 || len(segments[1]) == 0 {
-			return nil, fmt.Errorf("invalid value for --stubzones")
-		}
-
-		hosts := strings.Split(segments[1], ",")
-		for _, hostPort := range hosts {
-			hostPort = strings.TrimSpace(hostPort)
-			if strings.HasSuffix(hostPort, "]") {
-				hostPort += ":53"
-			} else if !strings.Contains(hostPort, ":") {
-				hostPort += ":53"
+		domains, hosts, found := strings.Cut(strings.TrimPrefix(strings.TrimSpace(stubzone), "/"), "/")
+		if !found || len(domains) == 0 {
+			return nil, fmt.Errorf("invalid value for --stubzones: %s", stubzone)
+		}
+
+		servers := []string{}
+		switch hosts = strings.TrimSpace(hosts); hosts {
+		case "":
+			// resolved locally only
+		case StubDefault:
+			servers = append(servers, StubDefault)
+		default:
+			for _, ns := range strings.Split(hosts, ",") {
+				ns, err := createNameserver(ns)
+				if err != nil {
+					return nil, fmt.Errorf("stubzone Server address is invalid: %s", err)
+				}
+				servers = append(servers, ns)
 			}
+		}
 
-			if err := validateHostPort(hostPort); err != nil {
-				return nil, fmt.Errorf("stubzone Server address is invalid: %s", err)
+		for _, sdomain := range strings.Split(domains, ",") {
+			sdomain = strings.TrimSpace(sdomain)
+			if _, ok := dns.IsDomainName(sdomain); !ok || dns.CountLabel(sdomain) < 1 {
+				return nil, fmt.Errorf("stubzone domain is not a fully-qualified domain name: %s", sdomain)
 			}
+			sdomain = dns.Fqdn(strings.ToLower(sdomain))
 
-			for _, sdomain := range strings.Split(segments[0], ",") {
-				if dns.CountLabel(sdomain) < 1 {
-					return nil, fmt.Errorf("stubzone domain is not a fully-qualified domain name: %s", sdomain)
-				}
-				sdomain = strings.TrimSpace(sdomain)
-				sdomain = dns.Fqdn(sdomain)
-				stubmap[sdomain] = append(stubmap[sdomain], hostPort)
+			existing, ok := stubmap[sdomain]
+			switch {
+			case !ok:
+				stubmap[sdomain] = append(make([]string, 0, len(servers)), servers...)
+			case isSpecialStub(existing) || isSpecialStub(servers):
+				return nil, fmt.Errorf("stubzone %s is configured more than once", sdomain)
+			default:
+				stubmap[sdomain] = append(existing, servers...)
 			}
 		}
 	}
@@ -207,6 +414,103 @@ func CreateStubMap(stubzones []string) (map[string][]string, error) {
 	return stubmap, nil
 }
 
+// CreateRevServerMap parses rules written as cidr[,host[:port][,host[:port]]]
+// that route reverse lookups of the addresses in cidr to the given
+// nameservers. The result maps the generated in-addr.arpa or ip6.arpa zones
+// to the nameservers, with the same exceptions as CreateStubMap.
+func CreateRevServerMap(rules []string) (map[string][]string, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	stubzones := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		cidr, hosts, _ := strings.Cut(strings.TrimSpace(rule), ",")
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --rev-server: %s", rule)
+		}
+		stubzones = append(stubzones, strings.Join(reverseZones(n), ",")+"/"+hosts)
+	}
+	revmap, err := CreateStubMap(stubzones)
+	if err != nil {
+		return nil, fmt.Errorf("rev-server: %s", err)
+	}
+	return revmap, nil
+}
+
+// isSpecialStub reports whether servers is not a plain list of nameservers.
+func isSpecialStub(servers []string) bool {
+	return len(servers) == 0 || servers[0] == StubDefault
+}
+
+// createNameserver validates a nameserver address and adds the default port
+// of its transport when it is missing.
+func createNameserver(ns string) (string, error) {
+	ns = strings.TrimSpace(ns)
+	if hostPort, ok := strings.CutPrefix(ns, tlsPrefix); ok {
+		hostPort, serverName, _ := strings.Cut(hostPort, "#")
+		hostPort = withDefaultPort(hostPort, "853")
+		if err := validateHostPort(hostPort); err != nil {
+			return "", err
+		}
+		ns = tlsPrefix + hostPort
+		if serverName != "" {
+			if _, ok := dns.IsDomainName(serverName); !ok {
+				return "", fmt.Errorf("bad TLS server name: %s", serverName)
+			}
+			ns += "#" + strings.TrimSuffix(serverName, ".")
+		}
+		return ns, nil
+	}
+	if strings.HasPrefix(ns, dnscryptPrefix) {
+		if _, err := parseStamp(ns); err != nil {
+			return "", err
+		}
+		return ns, nil
+	}
+	if strings.HasPrefix(ns, httpsPrefix) {
+		rawURL, bootstrap, _ := strings.Cut(ns, "#")
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", err
+		}
+		if u.Host == "" {
+			return "", fmt.Errorf("missing host in URL: %s", rawURL)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		ns = u.String()
+		if bootstrap != "" {
+			if ip := net.ParseIP(bootstrap); ip == nil {
+				return "", fmt.Errorf("bad bootstrap IP address: %s", bootstrap)
+			}
+			ns += "#" + bootstrap
+		}
+		return ns, nil
+	}
+
+	hostPort := withDefaultPort(ns, "53")
+	if err := validateHostPort(hostPort); err != nil {
+		return "", err
+	}
+	return hostPort, nil
+}
+
+func withDefaultPort(hostPort, port string) string {
+	if strings.HasSuffix(hostPort, "]") || !strings.Contains(hostPort, ":") {
+		return hostPort + ":" + port
+	}
+	return hostPort
+}
+
 func validateHostPort(hostPort string) error {
 	host, port, err := net.SplitHostPort(hostPort)
 	if err != nil {
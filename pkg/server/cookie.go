@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS cookies (RFC 7873). Server cookies use the layout of RFC 9018 with
+// HMAC-SHA256 in place of SipHash-2-4.
+const (
+	clientCookieLen  = 8
+	maxUpstreams     = 10000 // nameservers to keep cookies for
+	serverCookieLen  = 16
+	cookieVersion    = 1
+	cookieMaxAge     = time.Hour       // server cookies older than this are not accepted
+	cookieMaxSkew    = 5 * time.Minute // nor those issued this far in the future
+	maxCookieRetries = 1               // retries of a query answered with BADCOOKIE
+)
+
+var errCookieMismatch = errors.New("response carries a different client cookie")
+
+// CookieStatus is the outcome of checking the cookie a client sent. It tells
+// how likely it is that the source address of a query is not spoofed.
+type CookieStatus int
+
+const (
+	CookieNone      CookieStatus = iota // no cookie
+	CookieClient                        // a client cookie and no or an invalid server cookie
+	CookieValid                         // a server cookie that was issued to the client
+	CookieMalformed                     // an option of the wrong length
+)
+
+// RateLimitFunc decides whether a UDP query from addr is rate limited, given
+// the outcome of checking its cookie.
+type RateLimitFunc func(addr net.Addr, status CookieStatus) bool
+
+// upstreamCookies holds the client cookie used with each nameserver and the
+// server cookie it last returned.
+type upstreamCookies struct {
+	sync.Mutex
+	cookies map[string]*cookiePair
+}
+
+type cookiePair struct {
+	client string // hex encoded
+	server string
+}
+
+func newUpstreamCookies() *upstreamCookies {
+	return &upstreamCookies{cookies: make(map[string]*cookiePair)}
+}
+
+// get returns the cookie to send to ns, creating a client cookie on first use.
+func (c *upstreamCookies) get(ns string) string {
+	c.Lock()
+	defer c.Unlock()
+	p, ok := c.cookies[ns]
+	if !ok {
+		if len(c.cookies) >= maxUpstreams {
+			c.cookies = make(map[string]*cookiePair)
+		}
+		b := make([]byte, clientCookieLen)
+		rand.Read(b)
+		p = &cookiePair{client: hex.EncodeToString(b)}
+		c.cookies[ns] = p
+	}
+	return p.client + p.server
+}
+
+// request returns a copy of req that carries the cookie for ns instead of
+// any cookie of the client.
+func (c *upstreamCookies) request(ns string, req *dns.Msg) *dns.Msg {
+	req = req.Copy()
+	o := req.IsEdns0()
+	if o == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		o = req.IsEdns0()
+	}
+	removeCookie(o)
+	o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c.get(ns)})
+	return req
+}
+
+// response remembers the server cookie of ns in r and removes it from r.
+// A response that echoes another client cookie is rejected as spoofed.
+func (c *upstreamCookies) response(ns string, r *dns.Msg) error {
+	o := r.IsEdns0()
+	e := findCookie(o)
+	if e == nil {
+		return nil
+	}
+	removeCookie(o)
+
+	c.Lock()
+	defer c.Unlock()
+	p, ok := c.cookies[ns]
+	if !ok || len(e.Cookie) < 2*clientCookieLen || e.Cookie[:2*clientCookieLen] != p.client {
+		StatsCookieMismatchCount.Inc(1)
+		return errCookieMismatch
+	}
+	p.server = e.Cookie[2*clientCookieLen:]
+	return nil
+}
+
+// checkCookie verifies the cookie a UDP client sent with req and returns the
+// cookie for the reply, which is nil if the client sent none.
+func (s *Server) checkCookie(w dns.ResponseWriter, req *dns.Msg) (*dns.EDNS0_COOKIE, CookieStatus) {
+	if s.cookieSecret == nil || isTCP(w) {
+		return nil, CookieNone
+	}
+	e := findCookie(req.IsEdns0())
+	if e == nil {
+		return nil, CookieNone
+	}
+	cookie, err := hex.DecodeString(e.Cookie)
+	if err != nil || len(cookie) != clientCookieLen && (len(cookie) < clientCookieLen+8 || len(cookie) > clientCookieLen+32) {
+		log.Printf("D! [%d] Malformed cookie from %s", req.Id, w.RemoteAddr())
+		return nil, CookieMalformed
+	}
+
+	ip := remoteIP(w)
+	client := cookie[:clientCookieLen]
+	status := CookieClient
+	if server := cookie[clientCookieLen:]; len(server) > 0 {
+		if s.validServerCookie(client, server, ip, time.Now()) {
+			status = CookieValid
+			StatsCookieValidCount.Inc(1)
+		} else {
+			log.Printf("D! [%d] Invalid server cookie from %s", req.Id, w.RemoteAddr())
+			StatsCookieInvalidCount.Inc(1)
+		}
+	}
+	reply := hex.EncodeToString(client) + hex.EncodeToString(s.serverCookie(client, ip, time.Now()))
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: reply}, status
+}
+
+// serverCookie returns the server cookie for a client with the given client
+// cookie and address, issued at now.
+func (s *Server) serverCookie(client []byte, ip net.IP, now time.Time) []byte {
+	cookie := make([]byte, serverCookieLen)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+	mac := hmac.New(sha256.New, s.cookieSecret)
+	mac.Write(client)
+	mac.Write(cookie[:8])
+	mac.Write(ip)
+	copy(cookie[8:], mac.Sum(nil))
+	return cookie
+}
+
+// validServerCookie reports whether server was issued to the client and has
+// not expired.
+func (s *Server) validServerCookie(client, server []byte, ip net.IP, now time.Time) bool {
+	if len(server) != serverCookieLen || server[0] != cookieVersion {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if now.Sub(issued) > cookieMaxAge || issued.Sub(now) > cookieMaxSkew {
+		return false
+	}
+	want := s.serverCookie(client, ip, issued)
+	return hmac.Equal(want[8:], server[8:])
+}
+
+// setCookie adds cookie to the reply m, adding EDNS if m has none.
+func setCookie(req, m *dns.Msg, cookie *dns.EDNS0_COOKIE) {
+	o := m.IsEdns0()
+	if o == nil {
+		m.SetEdns0(dns.DefaultMsgSize, req.IsEdns0().Do())
+		o = m.IsEdns0()
+	}
+	removeCookie(o)
+	o.Option = append(o.Option, cookie)
+}
+
+// remoteIP returns the address of the client, IPv4 addresses in their
+// 4-byte form.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	var ip net.IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func findCookie(o *dns.OPT) *dns.EDNS0_COOKIE {
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if e, ok := opt.(*dns.EDNS0_COOKIE); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func removeCookie(o *dns.OPT) {
+	options := o.Option[:0]
+	for _, opt := range o.Option {
+		if _, ok := opt.(*dns.EDNS0_COOKIE); !ok {
+			options = append(options, opt)
+		}
+	}
+	o.Option = options
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func queryWithCookie(cookie string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("tomoyamachi.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	o := req.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return req
+}
+
+func TestServerCookies(t *testing.T) {
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{Cookies: true}, "", nil)
+	client := "0102030405060708"
+
+	// A client cookie alone gets a server cookie.
+	w := NewWriter("udp", "192.0.2.1:5353")
+	s.ServeDNS(w, queryWithCookie(client))
+	m := w.Msg()
+	if !assert.NotNil(t, m) || !assert.Len(t, m.Answer, 1) {
+		return
+	}
+	e := findCookie(m.IsEdns0())
+	if !assert.NotNil(t, e) {
+		return
+	}
+	assert.Len(t, e.Cookie, 2*(clientCookieLen+serverCookieLen))
+	assert.True(t, strings.HasPrefix(e.Cookie, client))
+
+	tampered := e.Cookie[:len(e.Cookie)-1] + "0"
+	if tampered == e.Cookie {
+		tampered = e.Cookie[:len(e.Cookie)-1] + "1"
+	}
+	tests := []struct {
+		desc   string
+		addr   string
+		cookie string
+		want   CookieStatus
+	}{
+		{desc: "none", addr: "192.0.2.1:5353", want: CookieNone},
+		{desc: "client cookie", addr: "192.0.2.1:5353", cookie: client, want: CookieClient},
+		{desc: "valid", addr: "192.0.2.1:5353", cookie: e.Cookie, want: CookieValid},
+		{desc: "other address", addr: "192.0.2.2:5353", cookie: e.Cookie, want: CookieClient},
+		{desc: "tampered", addr: "192.0.2.1:5353", cookie: tampered, want: CookieClient},
+		{desc: "short", addr: "192.0.2.1:5353", cookie: "0102", want: CookieMalformed},
+	}
+	for _, tc := range tests {
+		req := queryWithCookie(tc.cookie)
+		if tc.cookie == "" {
+			req.IsEdns0().Option = nil
+		}
+		_, status := s.checkCookie(NewWriter("udp", tc.addr), req)
+		assert.Equal(t, tc.want, status, tc.desc)
+	}
+
+	// A cookie issued too long ago has expired.
+	old := s.serverCookie([]byte{1, 2, 3, 4, 5, 6, 7, 8}, remoteIP(w), time.Now().Add(-2*cookieMaxAge))
+	assert.False(t, s.validServerCookie([]byte{1, 2, 3, 4, 5, 6, 7, 8}, old, remoteIP(w), time.Now()))
+
+	// A malformed cookie is a format error, TCP clients get no cookie.
+	w = NewWriter("udp", "192.0.2.1:5353")
+	s.ServeDNS(w, queryWithCookie("0102"))
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.Equal(t, dns.RcodeFormatError, m.Rcode)
+	}
+	w = NewWriter("tcp", "192.0.2.1:5353")
+	s.ServeDNS(w, queryWithCookie(client))
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.Nil(t, findCookie(m.IsEdns0()))
+	}
+
+	// The rate limiter sees the cookie status, limited clients are told to
+	// retry over TCP.
+	var statuses []CookieStatus
+	s.config.RateLimit = func(addr net.Addr, status CookieStatus) bool {
+		statuses = append(statuses, status)
+		return status != CookieValid
+	}
+	w = NewWriter("udp", "192.0.2.1:5353")
+	s.ServeDNS(w, queryWithCookie(client))
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.True(t, m.Truncated)
+		assert.Empty(t, m.Answer)
+		assert.NotNil(t, findCookie(m.IsEdns0()))
+	}
+	w = NewWriter("udp", "192.0.2.1:5353")
+	s.ServeDNS(w, queryWithCookie(e.Cookie))
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.False(t, m.Truncated)
+		assert.Len(t, m.Answer, 1)
+	}
+	w = NewWriter("tcp", "192.0.2.1:5353")
+	s.ServeDNS(w, queryWithCookie(client))
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.Len(t, m.Answer, 1)
+	}
+	assert.Equal(t, []CookieStatus{CookieClient, CookieValid}, statuses)
+}
+
+// cookieUpstream answers with a fixed server cookie and BADCOOKIE to
+// queries that do not carry it yet.
+type cookieUpstream struct {
+	sync.Mutex
+	seen  []string // cookies of the queries
+	spoof bool     // echo a different client cookie
+}
+
+const upstreamServerCookie = "00112233445566778899aabbccddeeff"
+
+func (u *cookieUpstream) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	u.Lock()
+	defer u.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetEdns0(4096, false)
+	e := findCookie(req.IsEdns0())
+	if e == nil {
+		w.WriteMsg(m)
+		return
+	}
+	u.seen = append(u.seen, e.Cookie)
+	client := e.Cookie[:2*clientCookieLen]
+	if u.spoof {
+		client = "ffffffffffffffff"
+	}
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + upstreamServerCookie})
+	if e.Cookie[2*clientCookieLen:] != upstreamServerCookie {
+		m.Rcode = dns.RcodeBadCookie
+	} else {
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 10.0.0.1")
+		m.Answer = []dns.RR{rr}
+	}
+	w.WriteMsg(m)
+}
+
+func TestUpstreamCookies(t *testing.T) {
+	u := &cookieUpstream{}
+	upstream := startUDPServer(t, "127.0.0.1:0", u)
+	s := New(nil, &Config{Nameservers: []string{upstream}, Cookies: true, ReadTimeout: time.Second}, "", nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	r, err := s.forwardQuery(context.Background(), req, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+		assert.Len(t, r.Answer, 1)
+		assert.Nil(t, findCookie(r.IsEdns0()))
+	}
+
+	// The first query had only the client cookie and was retried with the
+	// server cookie, which is remembered for the next query.
+	_, err = s.forwardQuery(context.Background(), req, false)
+	assert.NoError(t, err)
+	u.Lock()
+	if assert.Len(t, u.seen, 3) {
+		client := u.seen[0]
+		assert.Len(t, client, 2*clientCookieLen)
+		assert.Equal(t, client+upstreamServerCookie, u.seen[1])
+		assert.Equal(t, client+upstreamServerCookie, u.seen[2])
+	}
+	u.spoof = true
+	u.Unlock()
+
+	_, err = s.forwardUpstream(context.Background(), req, false)
+	assert.ErrorIs(t, err, errCookieMismatch)
+}
@@ -16,18 +16,63 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		log.Printf("D! [%d] Response time: %s", req.Id, elapsed)
 	}()
 
-	tcp, dnssec, bufsize, m, err := s.serveDNS(w, req)
-	if err != nil {
-		log.Printf("E! Failed to return reply %q", err)
+	cookie, status := s.checkCookie(w, req)
+	if status == CookieMalformed {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeFormatError)
+		if err := w.WriteMsg(m); err != nil {
+			log.Printf("E! Failed to return reply %q", err)
+		}
+		return
 	}
-
-	if m.Rcode == dns.RcodeServerFailure {
+	if s.config.RateLimit != nil && !isTCP(w) && s.config.RateLimit(w.RemoteAddr(), status) {
+		log.Printf("D! [%d] Rate limited query from %s", req.Id, w.RemoteAddr())
+		StatsRateLimitedCount.Inc(1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Truncated = true
+		if cookie != nil {
+			setCookie(req, m, cookie)
+		}
 		if err := w.WriteMsg(m); err != nil {
 			log.Printf("E! Failed to return reply %q", err)
 		}
 		return
 	}
 
+	tcp, dnssec, bufsize, m, stale, err := s.serveDNSOrStale(w, req)
+	if err != nil {
+		log.Printf("E! Failed to return reply %q", err)
+	}
+
+	// Answers that failed DNSSEC validation are cached like any other.
+	if m.Rcode == dns.RcodeServerFailure && !isBogus(m) {
+		stale := s.serveStale(w, req, dnssec, tcp)
+		if stale == nil {
+			s.ecsReply(req, m)
+			s.dnssecReply(req, m)
+			if cookie != nil {
+				setCookie(req, m, cookie)
+			}
+			if err := w.WriteMsg(m); err != nil {
+				log.Printf("E! Failed to return reply %q", err)
+			}
+			return
+		}
+		m = stale
+	} else if !stale && !m.Truncated && !s.unchecked(req) {
+		// Cache the whole message, it is fitted to the buffer of each client that
+		// gets it. Truncated messages are incomplete and not worth caching,
+		// answers that were not validated must not reach other clients. Stale
+		// answers are cached once they are refreshed.
+		s.cacheInsert(req.Question[0], dnssec, tcp, m, s.clientSubnet(w, req))
+	}
+	s.ecsReply(req, m)
+	s.dnssecReply(req, m)
+	if cookie != nil {
+		setCookie(req, m, cookie)
+	}
+
 	if tcp {
 		if _, overflow := Fit(m, dns.MaxMsgSize, tcp); overflow {
 			msgFail := new(dns.Msg)
@@ -38,7 +83,6 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	} else {
 		Fit(m, int(bufsize), tcp)
 	}
-	s.rcache.InsertMessage(cache.Key(req.Question[0], dnssec, tcp), m)
 
 	if err := w.WriteMsg(m); err != nil {
 		log.Printf("E! Failed to return reply %q", err)
@@ -53,22 +97,11 @@ func (s *Server) serveDNS(w dns.ResponseWriter, req *dns.Msg) (tcp, dnssec bool,
 	m.Authoritative = false
 	m.RecursionAvailable = true
 	m.Compress = true
-	bufsize = uint16(512)
 
 	q := req.Question[0]
 	name := strings.ToLower(q.Name)
 
-	if o := req.IsEdns0(); o != nil {
-		bufsize = o.UDPSize()
-		dnssec = o.Do()
-	}
-	if bufsize < 512 {
-		bufsize = 512
-	}
-	// with TCP we can send 64K
-	if tcp = isTCP(w); tcp {
-		bufsize = dns.MaxMsgSize - 1
-	}
+	tcp, dnssec, bufsize = requestOptions(w, req)
 
 	StatsRequestCount.Inc(1)
 
@@ -91,9 +124,16 @@ func (s *Server) serveDNS(w dns.ResponseWriter, req *dns.Msg) (tcp, dnssec bool,
 		}
 	}
 
-	// Check cache first.
-	if m1 := s.rcache.Hit(q, dnssec, tcp, m.Id); m1 != nil {
+	// Check cache first, unless the query refreshes the cached answer or
+	// asks for it unvalidated.
+	var m1 *dns.Msg
+	var key string
+	if _, refresh := w.(*refreshWriter); !refresh && !s.unchecked(req) {
+		m1, key = s.cacheHitKey(q, dnssec, tcp, m.Id, s.clientSubnet(w, req))
+	}
+	if m1 != nil {
 		log.Printf("D! [%d] Found cached response for this query", req.Id)
+		s.prefetch(w, req, key)
 		if tcp {
 			if _, overflow := Fit(m1, dns.MaxMsgSize, tcp); overflow {
 				msgFail := new(dns.Msg)
@@ -108,6 +148,12 @@ func (s *Server) serveDNS(w dns.ResponseWriter, req *dns.Msg) (tcp, dnssec bool,
 			s.RoundRobin(m1.Answer)
 		}
 		StatsCacheHit.Inc(1)
+		switch {
+		case m1.Rcode == dns.RcodeNameError:
+			StatsNameErrorCount.Inc(1)
+		case cache.IsNegative(m1):
+			StatsNoDataCount.Inc(1)
+		}
 		return tcp, dnssec, bufsize, m1, nil
 	}
 
@@ -195,3 +241,20 @@ func (s *Server) RoundRobin(rrs []dns.RR) {
 		}
 	}
 }
+
+// requestOptions returns the transport, DO bit and buffer size of req.
+func requestOptions(w dns.ResponseWriter, req *dns.Msg) (tcp, dnssec bool, bufsize uint16) {
+	bufsize = uint16(512)
+	if o := req.IsEdns0(); o != nil {
+		bufsize = o.UDPSize()
+		dnssec = o.Do()
+	}
+	if bufsize < 512 {
+		bufsize = 512
+	}
+	// with TCP we can send 64K
+	if tcp = isTCP(w); tcp {
+		bufsize = dns.MaxMsgSize - 1
+	}
+	return tcp, dnssec, bufsize
+}
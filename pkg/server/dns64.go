@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultDNS64Prefix is the well-known prefix of RFC 6052.
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// maxDNS64TTL caps the TTL of synthesized records if the NODATA answer has
+// no SOA record (RFC 6147 section 5.1.7).
+const maxDNS64TTL = 600
+
+// dns64 synthesizes AAAA records from A records (RFC 6147) by embedding the
+// IPv4 addresses into an IPv6 prefix (RFC 6052).
+type dns64 struct {
+	prefix  *net.IPNet
+	exclude []*net.IPNet // A and AAAA records that are never used
+	zone    string       // reverse zone of prefix
+}
+
+// newDNS64 parses the prefix, which defaults to DefaultDNS64Prefix, and the
+// networks excluded from synthesis.
+func newDNS64(prefix string, exclude []string) (*dns64, error) {
+	if prefix == "" {
+		prefix = DefaultDNS64Prefix
+	}
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	switch {
+	case bits != 128:
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", prefix)
+	case ones != 32 && ones != 40 && ones != 48 && ones != 56 && ones != 64 && ones != 96:
+		return nil, fmt.Errorf("%s must be a /32, /40, /48, /56, /64 or /96", prefix)
+	case n.IP[8] != 0:
+		return nil, fmt.Errorf("bits 64 to 71 of %s must be zero", prefix)
+	}
+	d := &dns64{prefix: n, zone: reverseZones(n)[0]}
+	for _, cidr := range exclude {
+		_, x, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		d.exclude = append(d.exclude, x)
+	}
+	return d, nil
+}
+
+// embed returns the IPv6 address of ip4 in the prefix.
+func (d *dns64) embed(ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	ones, _ := d.prefix.Mask.Size()
+	i := ones / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++ // the u octet stays zero
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// extract returns the IPv4 address embedded in ip, or nil if ip is not in
+// the prefix.
+func (d *dns64) extract(ip net.IP) net.IP {
+	if !d.prefix.Contains(ip) {
+		return nil
+	}
+	ones, _ := d.prefix.Mask.Size()
+	ip4 := make(net.IP, 0, net.IPv4len)
+	for i := ones / 8; len(ip4) < net.IPv4len; i++ {
+		if i != 8 {
+			ip4 = append(ip4, ip[i])
+		}
+	}
+	return ip4
+}
+
+// excluded reports whether ip must not be mapped or used as a AAAA record.
+func (d *dns64) excluded(ip net.IP) bool {
+	for _, n := range d.exclude {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesize returns AAAA records named name for the A records in rrs that
+// are not excluded. Their TTL is capped at ttl.
+func (d *dns64) synthesize(name string, rrs []dns.RR, ttl uint32) []dns.RR {
+	var aaaa []dns.RR
+	for _, rr := range rrs {
+		a, ok := rr.(*dns.A)
+		if !ok || d.excluded(a.A) {
+			continue
+		}
+		hdr := a.Hdr
+		hdr.Name = name
+		hdr.Rrtype = dns.TypeAAAA
+		if hdr.Ttl > ttl {
+			hdr.Ttl = ttl
+		}
+		aaaa = append(aaaa, &dns.AAAA{Hdr: hdr, AAAA: d.embed(a.A)})
+	}
+	return aaaa
+}
+
+// hasAAAA reports whether m answers with a AAAA record that is not excluded.
+// IPv4-mapped addresses are always excluded (RFC 6147 section 5.1.4).
+func (d *dns64) hasAAAA(m *dns.Msg) bool {
+	for _, rr := range m.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && aaaa.AAAA.To4() == nil && !d.excluded(aaaa.AAAA) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardDNS64 replaces the answer m to the AAAA query req with synthesized
+// records if it has no usable AAAA records and the name has A records.
+// Clients that validate DNSSEC themselves get the answer as is.
+func (s *Server) forwardDNS64(ctx context.Context, req, m *dns.Msg, tcp bool) *dns.Msg {
+	if m.Rcode != dns.RcodeSuccess || s.dns64.hasAAAA(m) {
+		return m
+	}
+	if o := req.IsEdns0(); o != nil && o.Do() && req.CheckingDisabled {
+		return m
+	}
+
+	areq := req.Copy()
+	areq.Question[0].Qtype = dns.TypeA
+	r := s.serveDNSForward(ctx, areq, tcp)
+	if r.Rcode != dns.RcodeSuccess {
+		return m
+	}
+
+	// The answer may start with a CNAME chain, the A records belong to its end.
+	var answer []dns.RR
+	var a []dns.RR
+	for _, rr := range r.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA:
+			a = append(a, rr)
+		case dns.TypeRRSIG:
+			// the signatures of the A records do not cover the synthesized ones
+		default:
+			answer = append(answer, rr)
+		}
+	}
+	if len(a) == 0 {
+		return m
+	}
+	aaaa := s.dns64.synthesize(a[0].Header().Name, a, dns64TTL(m.Ns))
+	if len(aaaa) == 0 {
+		return m
+	}
+	log.Printf("D! [%d] Synthesized %d AAAA records for '%s'", req.Id, len(aaaa), req.Question[0].Name)
+	StatsDNS64Count.Inc(1)
+
+	syn := r.Copy()
+	syn.Question = req.Question
+	syn.Answer = append(answer, aaaa...)
+	syn.Ns = nil
+	syn.AuthenticatedData = false // the synthesized records are not signed
+	return syn
+}
+
+// dns64TTL returns the limit of the TTL of synthesized records: the negative
+// TTL of the NODATA answer, or 600 seconds without a SOA record.
+func dns64TTL(ns []dns.RR) uint32 {
+	for _, rr := range ns {
+		if _, ok := rr.(*dns.SOA); ok {
+			return negativeTTL(ns)
+		}
+	}
+	return maxDNS64TTL
+}
+
+// reverseDNS64 answers the PTR query req for an address in the prefix with a
+// CNAME to the reverse name of the embedded IPv4 address and its answer.
+// It returns nil for other names.
+func (s *Server) reverseDNS64(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qtype != dns.TypePTR || !dns.IsSubDomain(s.dns64.zone, strings.ToLower(q.Name)) {
+		return nil
+	}
+	ip := reverseIP6(q.Name)
+	if ip == nil {
+		return nil
+	}
+	ip4 := s.dns64.extract(ip)
+	if ip4 == nil || s.dns64.excluded(ip4) {
+		return nil
+	}
+	target, _ := dns.ReverseAddr(ip4.String())
+
+	preq := req.Copy()
+	preq.Question[0].Name = target
+	m := s.ServeDNSReverse(w, preq)
+	m.Question = req.Question
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: s.config.HostsTtl},
+		Target: target,
+	}
+	m.Answer = append([]dns.RR{cname}, m.Answer...)
+	return m
+}
+
+const hexDigits = "0123456789abcdef"
+
+// reverseIP6 returns the address of a full ip6.arpa name, or nil.
+func reverseIP6(name string) net.IP {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	if len(labels) != 34 || labels[32] != "ip6" || labels[33] != "arpa" {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i := 0; i < 32; i++ {
+		l := labels[31-i]
+		if len(l) != 1 || strings.IndexByte(hexDigits, l[0]) < 0 {
+			return nil
+		}
+		nibble := byte(strings.IndexByte(hexDigits, l[0]))
+		if i%2 == 0 {
+			ip[i/2] = nibble << 4
+		} else {
+			ip[i/2] |= nibble
+		}
+	}
+	return ip
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNS64Embed(t *testing.T) {
+	// The examples of RFC 6052 section 2.4.
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "2001:db8::/32", want: "2001:db8:c000:221::"},
+		{prefix: "2001:db8:100::/40", want: "2001:db8:1c0:2:21::"},
+		{prefix: "2001:db8:122::/48", want: "2001:db8:122:c000:2:2100::"},
+		{prefix: "2001:db8:122:300::/56", want: "2001:db8:122:3c0:0:221::"},
+		{prefix: "2001:db8:122:344::/64", want: "2001:db8:122:344:c0:2:2100:0"},
+		{prefix: "2001:db8:122:344::/96", want: "2001:db8:122:344::c000:221"},
+	}
+	ip4 := net.ParseIP("192.0.2.33")
+	for _, tc := range tests {
+		d, err := newDNS64(tc.prefix, nil)
+		if !assert.NoError(t, err, tc.prefix) {
+			continue
+		}
+		ip := d.embed(ip4)
+		assert.Equal(t, tc.want, ip.String(), tc.prefix)
+		assert.Equal(t, "192.0.2.33", d.extract(ip).String(), tc.prefix)
+	}
+
+	for _, prefix := range []string{"64:ff9b::/80", "10.0.0.0/8", "2001:db8:0:0:ff00::/96"} {
+		_, err := newDNS64(prefix, nil)
+		assert.Error(t, err, prefix)
+	}
+}
+
+func TestServeDNS64(t *testing.T) {
+	upstream := startUDPServer(t, "127.0.0.1:0", authServer(t,
+		"test. 3600 IN SOA ns.test. hostmaster.test. 1 1800 900 604800 60",
+		"in-addr.arpa. 3600 IN SOA ns.test. hostmaster.test. 1 1800 900 604800 60",
+		"v4only.test. 300 IN A 192.0.2.1",
+		"dual.test. 300 IN A 192.0.2.2",
+		"dual.test. 300 IN AAAA 2001:db8::2",
+		"mapped.test. 300 IN A 192.0.2.3",
+		"mapped.test. 300 IN AAAA ::ffff:192.0.2.3",
+		"excluded.test. 300 IN A 198.51.100.1",
+		"1.2.0.192.in-addr.arpa. 300 IN PTR v4only.test.",
+	))
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{
+		Nameservers:  []string{upstream},
+		DNS64:        true,
+		DNS64Exclude: []string{"198.51.100.0/24"},
+		ReadTimeout:  time.Second,
+		HostsTtl:     10,
+	}, "", nil)
+
+	tests := []struct {
+		name    string
+		want    []string
+		wantTTL uint32
+	}{
+		{name: "v4only.test.", want: []string{"64:ff9b::c000:201"}, wantTTL: 60},
+		{name: "dual.test.", want: []string{"2001:db8::2"}, wantTTL: 300},
+		{name: "mapped.test.", want: []string{"64:ff9b::c000:203"}, wantTTL: 300},
+		{name: "excluded.test."},
+		{name: "tomoyamachi.com.", want: []string{"64:ff9b::6f0b:b0b"}, wantTTL: 10},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeAAAA)
+		w := NewWriter("udp", "127.0.0.1:0")
+		s.ServeDNS(w, req)
+		m := w.Msg()
+		if !assert.NotNil(t, m, tc.name) {
+			continue
+		}
+		assert.Equal(t, dns.RcodeSuccess, m.Rcode, tc.name)
+		var got []string
+		for _, rr := range m.Answer {
+			if aaaa, ok := rr.(*dns.AAAA); ok {
+				got = append(got, aaaa.AAAA.String())
+				assert.Equal(t, tc.wantTTL, aaaa.Hdr.Ttl, tc.name)
+			}
+		}
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+
+	// The reverse name of a mapped address points to that of the IPv4 address.
+	name, _ := dns.ReverseAddr("64:ff9b::c000:201")
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypePTR)
+	w := NewWriter("udp", "127.0.0.1:0")
+	s.ServeDNS(w, req)
+	if m := w.Msg(); assert.NotNil(t, m) && assert.Len(t, m.Answer, 2) {
+		assert.Equal(t, name, m.Question[0].Name)
+		assert.Equal(t, "1.2.0.192.in-addr.arpa.", m.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "v4only.test.", m.Answer[1].(*dns.PTR).Ptr)
+	}
+}
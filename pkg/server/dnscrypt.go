@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DNSCrypt version 2 (https://dnscrypt.info/protocol) with the
+// X25519-XSalsa20Poly1305 construction.
+const (
+	dnscryptPrefix       = "sdns://"
+	dnscryptStampVersion = 0x01 // protocol identifier of DNSCrypt stamps
+	dnscryptCertSize     = 124
+	dnscryptESVersion    = 0x0001 // X25519-XSalsa20Poly1305
+	dnscryptNonceSize    = 12     // the client half of the nonce
+	dnscryptMinQuerySize = 256    // UDP queries are padded to at least this size
+	dnscryptBlockSize    = 64     // and to a multiple of it
+	dnscryptCertRefresh  = time.Hour
+	dnscryptCertRetry    = time.Minute // after a failed refresh
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+	errDNSCryptNoCert     = errors.New("no valid DNSCrypt certificate")
+	errDNSCryptResponse   = errors.New("invalid DNSCrypt response")
+)
+
+// dnscryptStamp is a DNSCrypt server stamp (sdns://...).
+type dnscryptStamp struct {
+	addr         string // ip:port of the resolver
+	providerKey  ed25519.PublicKey
+	providerName string // name of the TXT records holding the certificates
+}
+
+// parseStamp decodes a DNSCrypt stamp: the protocol identifier, 8 bytes of
+// properties, then the address, the provider public key and the provider
+// name, each prefixed with its length.
+func parseStamp(stamp string) (*dnscryptStamp, error) {
+	rest, ok := strings.CutPrefix(stamp, dnscryptPrefix)
+	if !ok {
+		return nil, fmt.Errorf("not a stamp: %s", stamp)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("bad stamp encoding: %s", err)
+	}
+	if len(b) < 9 || b[0] != dnscryptStampVersion {
+		return nil, fmt.Errorf("not a DNSCrypt stamp: %s", stamp)
+	}
+	b = b[9:]
+	var fields [3][]byte
+	for i := range fields {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, fmt.Errorf("truncated stamp: %s", stamp)
+		}
+		fields[i], b = b[1:1+int(b[0])], b[1+int(b[0]):]
+	}
+
+	addr := string(fields[0])
+	if ip := net.ParseIP(addr); ip != nil || addr != "" && addr[0] == '[' && addr[len(addr)-1] == ']' {
+		addr = withDefaultPort(addr, "443")
+	}
+	if err := validateHostPort(addr); err != nil {
+		return nil, err
+	}
+	if len(fields[1]) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad provider public key in stamp: %s", stamp)
+	}
+	name := dns.Fqdn(string(fields[2]))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return nil, fmt.Errorf("bad provider name in stamp: %s", stamp)
+	}
+	return &dnscryptStamp{addr: addr, providerKey: ed25519.PublicKey(fields[1]), providerName: name}, nil
+}
+
+// dnscryptCert is a resolver certificate along with the key pair the client
+// uses with it.
+type dnscryptCert struct {
+	serial      uint32
+	clientMagic [8]byte
+	notAfter    time.Time
+	publicKey   *[32]byte // of the client
+	sharedKey   [32]byte
+}
+
+// parseCert checks the signature and validity of a certificate and derives
+// a shared key for it.
+func parseCert(b []byte, providerKey ed25519.PublicKey, now time.Time) (*dnscryptCert, error) {
+	if len(b) < dnscryptCertSize || !bytes.Equal(b[:4], dnscryptCertMagic) {
+		return nil, errors.New("not a DNSCrypt certificate")
+	}
+	if v := binary.BigEndian.Uint16(b[4:6]); v != dnscryptESVersion {
+		return nil, fmt.Errorf("unsupported encryption system %d", v)
+	}
+	if !ed25519.Verify(providerKey, b[72:], b[8:72]) {
+		return nil, errors.New("bad certificate signature")
+	}
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	notAfter := time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	if now.Before(notBefore) || !now.Before(notAfter) {
+		return nil, fmt.Errorf("certificate is valid from %s to %s", notBefore, notAfter)
+	}
+
+	c := &dnscryptCert{serial: binary.BigEndian.Uint32(b[112:116]), notAfter: notAfter}
+	copy(c.clientMagic[:], b[104:112])
+	var resolverKey [32]byte
+	copy(resolverKey[:], b[72:104])
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c.publicKey = pub
+	box.Precompute(&c.sharedKey, &resolverKey, priv)
+	return c, nil
+}
+
+// encrypt returns the query packet for msg and the client nonce in it.
+func (c *dnscryptCert) encrypt(msg []byte, tcp bool) ([]byte, []byte) {
+	size := (len(msg) + 1 + dnscryptBlockSize - 1) / dnscryptBlockSize * dnscryptBlockSize
+	if !tcp && size < dnscryptMinQuerySize {
+		size = dnscryptMinQuerySize
+	}
+	padded := make([]byte, size)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+
+	var nonce [24]byte
+	rand.Read(nonce[:dnscryptNonceSize])
+	packet := make([]byte, 0, 8+32+dnscryptNonceSize+size+box.Overhead)
+	packet = append(packet, c.clientMagic[:]...)
+	packet = append(packet, c.publicKey[:]...)
+	packet = append(packet, nonce[:dnscryptNonceSize]...)
+	packet = box.SealAfterPrecomputation(packet, padded, &nonce, &c.sharedKey)
+	return packet, nonce[:dnscryptNonceSize]
+}
+
+// decrypt returns the response in packet, which must echo the client nonce.
+func (c *dnscryptCert) decrypt(packet, clientNonce []byte) ([]byte, error) {
+	if len(packet) < 8+24+box.Overhead || !bytes.Equal(packet[:8], dnscryptResolverMagic) ||
+		!bytes.Equal(packet[8:8+dnscryptNonceSize], clientNonce) {
+		return nil, errDNSCryptResponse
+	}
+	var nonce [24]byte
+	copy(nonce[:], packet[8:32])
+	msg, ok := box.OpenAfterPrecomputation(nil, packet[32:], &nonce, &c.sharedKey)
+	if !ok {
+		return nil, errDNSCryptResponse
+	}
+	i := bytes.LastIndexByte(msg, 0x80)
+	if i < 0 || len(bytes.Trim(msg[i+1:], "\x00")) > 0 {
+		return nil, errDNSCryptResponse
+	}
+	return msg[:i], nil
+}
+
+// dnscryptResolver is a DNSCrypt nameserver and its current certificate.
+type dnscryptResolver struct {
+	stamp *dnscryptStamp
+	sync.Mutex
+	cert    *dnscryptCert
+	refresh time.Time // when the certificate is fetched again
+}
+
+type dnscryptResolvers struct {
+	resolvers map[string]*dnscryptResolver
+	sync.Mutex
+}
+
+// dnscryptResolver returns the DNSCrypt nameserver for the stamp ns.
+func (s *Server) dnscryptResolver(ns string) (*dnscryptResolver, error) {
+	s.dnscrypt.Lock()
+	defer s.dnscrypt.Unlock()
+	if r, ok := s.dnscrypt.resolvers[ns]; ok {
+		return r, nil
+	}
+	stamp, err := parseStamp(ns)
+	if err != nil {
+		return nil, err
+	}
+	r := &dnscryptResolver{stamp: stamp}
+	if s.dnscrypt.resolvers == nil {
+		s.dnscrypt.resolvers = make(map[string]*dnscryptResolver)
+	}
+	s.dnscrypt.resolvers[ns] = r
+	return r, nil
+}
+
+// certificate returns the certificate to use with r. It is fetched again
+// every dnscryptCertRefresh to pick up rotated certificates, the old one is
+// kept while it is valid if that fails.
+func (s *Server) certificate(ctx context.Context, r *dnscryptResolver) (*dnscryptCert, error) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	if r.cert != nil && now.Before(r.refresh) {
+		return r.cert, nil
+	}
+	cert, err := s.fetchCert(ctx, r.stamp, now)
+	if err != nil {
+		if r.cert != nil && now.Before(r.cert.notAfter) {
+			log.Printf("E! Failed to refresh DNSCrypt certificate of %s, keeping the current one: %v", r.stamp.providerName, err)
+			r.refresh = now.Add(dnscryptCertRetry)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert == nil || r.cert.serial != cert.serial {
+		log.Printf("D! Using DNSCrypt certificate %d of %s, valid until %s", cert.serial, r.stamp.providerName, cert.notAfter)
+	}
+	r.cert = cert
+	r.refresh = now.Add(dnscryptCertRefresh)
+	if cert.notAfter.Before(r.refresh) {
+		r.refresh = cert.notAfter
+	}
+	return cert, nil
+}
+
+// expire makes the next query fetch the certificate again, e.g. because the
+// resolver no longer accepts the current one.
+func (r *dnscryptResolver) expire() {
+	r.Lock()
+	r.refresh = time.Time{}
+	r.Unlock()
+}
+
+// fetchCert gets the certificates of a resolver from the TXT records of its
+// provider name and returns the valid one with the highest serial.
+func (s *Server) fetchCert(ctx context.Context, stamp *dnscryptStamp, now time.Time) (*dnscryptCert, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(stamp.providerName, dns.TypeTXT)
+	r, _, err := s.dnsUDPClient.ExchangeContext(ctx, m, stamp.addr)
+	if err == nil && r.Truncated {
+		r, _, err = s.dnsTCPClient.ExchangeContext(ctx, m, stamp.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := parseCert(txtBytes(txt.Txt), stamp.providerKey, now)
+		if err != nil {
+			log.Printf("D! Ignoring DNSCrypt certificate of %s: %v", stamp.providerName, err)
+			continue
+		}
+		if best == nil || cert.serial > best.serial {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, errDNSCryptNoCert
+	}
+	return best, nil
+}
+
+// exchangeDNSCrypt sends req to a DNSCrypt nameserver over the transport the
+// client used, and again over TCP if the UDP response is truncated.
+func (s *Server) exchangeDNSCrypt(ctx context.Context, req *dns.Msg, ns string, tcp bool) (*dns.Msg, error) {
+	res, err := s.dnscryptResolver(ns)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := s.certificate(ctx, res)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.dnscryptQuery(ctx, req, res.stamp.addr, cert, tcp)
+	if err != nil {
+		// The resolver may have rotated its certificate.
+		res.expire()
+		return nil, err
+	}
+	if r.Truncated && !tcp {
+		log.Printf("D! [%d] Truncated response from upstream %s, retrying over TCP", req.Id, res.stamp.addr)
+		StatsTruncatedRetryCount.Inc(1)
+		full, tcpErr := s.dnscryptQuery(ctx, req, res.stamp.addr, cert, true)
+		if tcpErr == nil {
+			return full, nil
+		}
+		log.Printf("D! [%d] Failed to retry query over TCP with upstream %s: %v", req.Id, res.stamp.addr, tcpErr)
+	}
+	return r, nil
+}
+
+// dnscryptQuery sends one encrypted query to addr and decrypts the response.
+func (s *Server) dnscryptQuery(ctx context.Context, req *dns.Msg, addr string, cert *dnscryptCert, tcp bool) (*dns.Msg, error) {
+	msg, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	packet, nonce := cert.encrypt(msg, tcp)
+
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	dialer := net.Dialer{Timeout: s.dnsUDPClient.ReadTimeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(s.dnsUDPClient.ReadTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	var resp []byte
+	if tcp {
+		if _, err := conn.Write(append([]byte{byte(len(packet) >> 8), byte(len(packet))}, packet...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp = resp[:n]
+	}
+
+	plain, err := cert.decrypt(resp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(plain); err != nil {
+		return nil, err
+	}
+	if r.Id != req.Id {
+		return nil, dns.ErrId
+	}
+	return r, nil
+}
+
+// txtBytes returns the binary data of the strings of a TXT record, which are
+// in presentation format.
+func txtBytes(txt []string) []byte {
+	var b []byte
+	for _, s := range txt {
+		for i := 0; i < len(s); i++ {
+			if s[i] != '\\' || i+1 == len(s) {
+				b = append(b, s[i])
+				continue
+			}
+			if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+				n, _ := strconv.Atoi(s[i+1 : i+4])
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+			b = append(b, s[i+1])
+			i++
+		}
+	}
+	return b
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// dnscryptStandIn is a DNSCrypt resolver that answers with handler.
+type dnscryptStandIn struct {
+	providerKey  ed25519.PrivateKey
+	providerName string
+	handler      dns.HandlerFunc
+	addr         string
+
+	sync.Mutex
+	certs [][]byte              // served as TXT records
+	keys  map[[8]byte]*[32]byte // resolver secret keys by client magic
+}
+
+func startDNSCrypt(t *testing.T, handler dns.HandlerFunc) *dnscryptStandIn {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	d := &dnscryptStandIn{providerKey: priv, providerName: "2.dnscrypt-cert.example.test.", handler: handler}
+	d.rotate(1)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.addr = pc.LocalAddr().String()
+	l, err := net.Listen("tcp", d.addr)
+	if err != nil {
+		pc.Close()
+		t.Skipf("cannot listen on %s over TCP: %v", d.addr, err)
+	}
+	t.Cleanup(func() { pc.Close(); l.Close() })
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := d.serve(buf[:n], false); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, packet); err != nil {
+					return
+				}
+				if resp := d.serve(packet, true); resp != nil {
+					conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+				}
+			}()
+		}
+	}()
+	return d
+}
+
+// rotate replaces the certificate with a new one for a new key.
+func (d *dnscryptStandIn) rotate(serial uint32) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	var magic [8]byte
+	copy(magic[:], pub[:8])
+	now := time.Now()
+
+	signed := append(pub[:], magic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(now.Add(-time.Hour).Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(now.Add(time.Hour).Unix()))
+	cert := append([]byte("DNSC\x00\x01\x00\x00"), ed25519.Sign(d.providerKey, signed)...)
+	cert = append(cert, signed...)
+
+	d.Lock()
+	defer d.Unlock()
+	d.certs = [][]byte{cert}
+	d.keys = map[[8]byte]*[32]byte{magic: priv}
+}
+
+func (d *dnscryptStandIn) stamp() string {
+	b := []byte{dnscryptStampVersion, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, field := range [][]byte{[]byte(d.addr), d.providerKey.Public().(ed25519.PublicKey), []byte(d.providerName)} {
+		b = append(b, byte(len(field)))
+		b = append(b, field...)
+	}
+	return dnscryptPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// serve answers a packet with the certificates or an encrypted response.
+// Queries for an unknown certificate are dropped.
+func (d *dnscryptStandIn) serve(packet []byte, tcp bool) []byte {
+	d.Lock()
+	certs := d.certs
+	var magic [8]byte
+	copy(magic[:], packet)
+	key, encrypted := d.keys[magic]
+	d.Unlock()
+
+	if !encrypted {
+		req := new(dns.Msg)
+		if err := req.Unpack(packet); err != nil {
+			return nil
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name == d.providerName && req.Question[0].Qtype == dns.TypeTXT {
+			for _, cert := range certs {
+				var txt bytes.Buffer
+				for _, c := range cert {
+					fmt.Fprintf(&txt, "\\%03d", c)
+				}
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: d.providerName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{txt.String()},
+				})
+			}
+		}
+		resp, _ := m.Pack()
+		return resp
+	}
+
+	if len(packet) < 52+box.Overhead {
+		return nil
+	}
+	var clientKey [32]byte
+	copy(clientKey[:], packet[8:40])
+	var nonce [24]byte
+	copy(nonce[:], packet[40:52])
+	padded, ok := box.Open(nil, packet[52:], &nonce, &clientKey, key)
+	if !ok {
+		return nil
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(padded[:bytes.LastIndexByte(padded, 0x80)]); err != nil {
+		return nil
+	}
+	w := NewWriter("udp", "127.0.0.1:0")
+	d.handler(w, req)
+	resp, _ := w.Msg().Pack()
+	if !tcp && len(resp) > len(packet) {
+		m := w.Msg()
+		m.Truncated = true
+		m.Answer = nil
+		resp, _ = m.Pack()
+	}
+
+	rand.Read(nonce[12:])
+	resp = append(resp, 0x80)
+	for len(resp)%64 != 0 {
+		resp = append(resp, 0)
+	}
+	out := append(append([]byte{}, dnscryptResolverMagic...), nonce[:]...)
+	return box.Seal(out, resp, &nonce, &clientKey, key)
+}
+
+func answerAs(n int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		for i := 0; i < n; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 1, byte(i)),
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestDNSCrypt(t *testing.T) {
+	d := startDNSCrypt(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Name == "big.example.com." {
+			answerAs(40)(w, req)
+		} else {
+			answerAs(1)(w, req)
+		}
+	})
+	stamp := d.stamp()
+	nameservers, err := CreateNameservers([]string{stamp})
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := New(nil, &Config{Nameservers: nameservers, Attempts: 2, ReadTimeout: 200 * time.Millisecond}, "", nil)
+
+	query := func(name string) (*dns.Msg, error) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		return s.forwardQuery(context.Background(), req, false)
+	}
+	r, err := query("example.com.")
+	if assert.NoError(t, err) && assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, "10.0.1.0", r.Answer[0].(*dns.A).A.String())
+	}
+
+	// A response that does not fit into the padded UDP query comes over TCP.
+	r, err = query("big.example.com.")
+	if assert.NoError(t, err) {
+		assert.False(t, r.Truncated)
+		assert.Len(t, r.Answer, 40)
+	}
+
+	// After the resolver rotated its key, the first attempt times out and
+	// the second one uses the new certificate.
+	d.rotate(2)
+	r, err = query("example.com.")
+	if assert.NoError(t, err) {
+		assert.Len(t, r.Answer, 1)
+	}
+	res, _ := s.dnscryptResolver(stamp)
+	assert.Equal(t, uint32(2), res.cert.serial)
+}
+
+func TestParseStamp(t *testing.T) {
+	d := &dnscryptStandIn{addr: "192.0.2.1", providerName: "2.dnscrypt-cert.example.test"}
+	_, d.providerKey, _ = ed25519.GenerateKey(rand.Reader)
+	stamp, err := parseStamp(d.stamp())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:443", stamp.addr)
+		assert.Equal(t, "2.dnscrypt-cert.example.test.", stamp.providerName)
+	}
+
+	for _, bad := range []string{"sdns://AQ", "sdns://!!!", "sdns://AgAAAAAAAAAAAA"} {
+		_, err := CreateNameservers([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
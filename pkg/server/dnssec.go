@@ -0,0 +1,845 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootAnchors are the DS records of the root key signing keys KSK-2017 and KSK-2024.
+const rootAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// Results of the validation of an answer (RFC 4035 section 4.3).
+type validation int
+
+const (
+	insecure validation = iota
+	secure
+	bogus
+)
+
+func (v validation) String() string {
+	return [...]string{"insecure", "secure", "bogus"}[v]
+}
+
+const (
+	minZoneKeysTTL = 60
+	maxZoneKeysTTL = 3600
+	maxZoneKeys    = 10000
+)
+
+var errBogus = errors.New("DNSSEC validation failed")
+
+// fetchError is the failure to look up the records needed to validate an
+// answer. Unlike a signature or proof that does not check out, it says
+// nothing about the answer, which is neither secure nor bogus.
+type fetchError struct {
+	name  string
+	qtype uint16
+	err   error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("looking up %s of %s: %v", dns.TypeToString[e.qtype], e.name, e.err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+// supportedAlgorithms are the DNSSEC algorithms that signatures can be
+// verified with. Zones signed only with others are treated as insecure.
+var supportedAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+// zoneKeys is the validated state of the closest enclosing zone of a name.
+type zoneKeys struct {
+	zone    string
+	keys    []*dns.DNSKEY // validated keys of zone, nil if it is insecure
+	expires time.Time
+}
+
+// validator checks the DNSSEC signatures of answers, starting from the
+// trust anchors and caching the zone keys it validated on the way.
+type validator struct {
+	anchors map[string][]dns.RR // zone -> DS or DNSKEY records
+	sync.Mutex
+	zones map[string]zoneKeys // name -> state of its closest enclosing zone
+}
+
+func newValidator(anchors []dns.RR) *validator {
+	v := &validator{anchors: make(map[string][]dns.RR), zones: make(map[string]zoneKeys)}
+	for _, rr := range anchors {
+		zone := strings.ToLower(rr.Header().Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	return v
+}
+
+// loadTrustAnchors reads the DS and DNSKEY records of a file in zone file
+// syntax. Without a path the root anchors are returned.
+func loadTrustAnchors(path string) ([]dns.RR, error) {
+	data := rootAnchors
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	}
+	var anchors []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(data), ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			anchors = append(anchors, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no DS or DNSKEY records in %s", path)
+	}
+	return anchors, nil
+}
+
+// validatedQuery forwards req with the DO bit set and validates the answer.
+// Secure answers get the AD bit, bogus ones are replaced by SERVFAIL with an
+// extended DNS error, which is how the result is kept in the cache. If the
+// keys or proofs to validate with cannot be looked up, the error is returned
+// like that of the query itself. Clients that set the CD bit validate
+// themselves and get the answer as is.
+func (s *Server) validatedQuery(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, error) {
+	up := req.Copy()
+	if o := up.IsEdns0(); o != nil {
+		o.SetDo()
+	} else {
+		up.SetEdns0(4096, true)
+	}
+	up.CheckingDisabled = true
+
+	r, err := s.forwardUpstream(ctx, up, tcp)
+	if err != nil || r.Rcode == dns.RcodeServerFailure {
+		return r, err
+	}
+	if req.CheckingDisabled {
+		log.Printf("D! [%d] Not validating '%s', checking disabled", req.Id, req.Question[0].Name)
+		r.AuthenticatedData = false
+		return r, nil
+	}
+	result, err := s.validate(ctx, req.Question[0], r)
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		log.Printf("E! [%d] DNSSEC validation of '%s' not possible: %v", req.Id, req.Question[0].Name, err)
+		return nil, err
+	}
+	log.Printf("D! [%d] DNSSEC validation of '%s': %s", req.Id, req.Question[0].Name, result)
+	switch result {
+	case secure:
+		StatsDnssecSecureCount.Inc(1)
+		r.AuthenticatedData = true
+	case insecure:
+		StatsDnssecInsecureCount.Inc(1)
+		r.AuthenticatedData = false
+	case bogus:
+		StatsDnssecBogusCount.Inc(1)
+		log.Printf("E! [%d] DNSSEC validation of '%s' failed: %v", req.Id, req.Question[0].Name, err)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.SetEdns0(4096, true)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus})
+		return m, nil
+	}
+	return r, nil
+}
+
+// unchecked reports whether req is forwarded without validation, as the
+// client set the CD bit. The answer is not cached.
+func (s *Server) unchecked(req *dns.Msg) bool {
+	return s.config.DNSSEC && req.CheckingDisabled
+}
+
+// validate checks the signatures of the answer r to q.
+func (s *Server) validate(ctx context.Context, q dns.Question, r *dns.Msg) (validation, error) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return insecure, nil
+	}
+	result := secure
+
+	sets, sigs := splitRRsets(r.Answer)
+	for _, set := range sets {
+		v, ce, err := s.validateRRset(ctx, set, sigs)
+		if err != nil {
+			return bogus, err
+		}
+		if v == insecure {
+			result = insecure
+		}
+		if ce == "" {
+			continue
+		}
+		// An RRset expanded from a wildcard needs a proof that there is no
+		// closer match for its owner.
+		owner := set[0].Header().Name
+		zk, err := s.zoneFor(ctx, ce)
+		if err != nil {
+			return bogus, err
+		}
+		if err := s.validateAuthority(r.Ns, zk); err != nil {
+			return bogus, err
+		}
+		if !provesNoCloserMatch(r.Ns, owner, ce) {
+			return bogus, fmt.Errorf("no proof that %s is not a closer match than the wildcard at %s", owner, ce)
+		}
+	}
+
+	// A negative answer, or one that ends in a CNAME, has to prove that the
+	// records do not exist.
+	name := q.Name
+	if target := cnameTarget(r.Answer, q); target != "" {
+		name = target
+	}
+	if r.Rcode == dns.RcodeSuccess && hasRRset(r.Answer, name, q.Qtype) {
+		return result, nil
+	}
+	if r.Rcode == dns.RcodeSuccess && q.Qtype == dns.TypeANY && len(r.Answer) > 0 {
+		return result, nil
+	}
+	zk, err := s.zoneFor(ctx, name)
+	if err != nil {
+		return bogus, err
+	}
+	if zk.keys == nil {
+		return insecure, nil
+	}
+	if err := s.validateAuthority(r.Ns, zk); err != nil {
+		return bogus, err
+	}
+	if !provesDenial(r.Ns, name, q.Qtype, r.Rcode == dns.RcodeNameError) {
+		return bogus, fmt.Errorf("no proof that %s %s does not exist", name, dns.TypeToString[q.Qtype])
+	}
+	return result, nil
+}
+
+// validateRRset checks the signature of one RRset of an answer. If the
+// RRset was expanded from a wildcard, it returns the closest encloser of its
+// owner, the name the wildcard is at.
+func (s *Server) validateRRset(ctx context.Context, set []dns.RR, sigs []*dns.RRSIG) (validation, string, error) {
+	owner := set[0].Header().Name
+	covering := sigsFor(sigs, owner, set[0].Header().Rrtype)
+	if len(covering) == 0 {
+		zk, err := s.zoneFor(ctx, owner)
+		if err != nil {
+			return bogus, "", err
+		}
+		if zk.keys != nil {
+			return bogus, "", fmt.Errorf("%s %s is not signed", owner, dns.TypeToString[set[0].Header().Rrtype])
+		}
+		return insecure, "", nil
+	}
+
+	signer := strings.ToLower(covering[0].SignerName)
+	if !dns.IsSubDomain(signer, strings.ToLower(owner)) {
+		return bogus, "", fmt.Errorf("%s is signed by %s", owner, signer)
+	}
+	zk, err := s.zoneFor(ctx, signer)
+	if err != nil {
+		return bogus, "", err
+	}
+	if zk.keys == nil {
+		return insecure, "", nil
+	}
+	if zk.zone != signer {
+		return bogus, "", fmt.Errorf("%s is signed by %s, which is not a zone", owner, signer)
+	}
+	sig, err := verifyRRset(set, covering, zk)
+	if err != nil {
+		return bogus, "", err
+	}
+
+	// The signature of a wildcard has fewer labels than the names it is
+	// expanded to (RFC 4035 section 5.3.4).
+	labels := dns.SplitDomainName(strings.ToLower(owner))
+	if len(labels) > 0 && labels[0] == "*" {
+		labels = labels[1:]
+	}
+	switch n := int(sig.Labels); {
+	case n > len(labels):
+		return bogus, "", fmt.Errorf("%w: signature of %s has %d labels", errBogus, owner, n)
+	case n < len(labels):
+		return secure, dns.Fqdn(strings.Join(labels[len(labels)-n:], ".")), nil
+	}
+	return secure, "", nil
+}
+
+// validateAuthority checks the signatures of the SOA, NSEC and NSEC3 records
+// of a negative answer from zone zk.
+func (s *Server) validateAuthority(ns []dns.RR, zk zoneKeys) error {
+	sets, sigs := splitRRsets(ns)
+	for _, set := range sets {
+		switch set[0].Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		if _, err := verifyRRset(set, sigsFor(sigs, set[0].Header().Name, set[0].Header().Rrtype), zk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneFor returns the validated keys of the closest enclosing zone of name.
+// Below a delegation that is proven to have no DS records the zone is
+// insecure. Secure zones are found by following the DS records down from
+// a trust anchor.
+func (s *Server) zoneFor(ctx context.Context, name string) (zoneKeys, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	v := s.validator
+	v.Lock()
+	zk, ok := v.zones[name]
+	v.Unlock()
+	if ok && time.Now().Before(zk.expires) {
+		return zk, nil
+	}
+
+	var ttl uint32
+	var err error
+	switch anchors, ok := v.anchors[name]; {
+	case ok:
+		zk = zoneKeys{zone: name}
+		zk.keys, ttl, err = s.fetchKeys(ctx, name, anchors)
+	case name == ".":
+		zk = zoneKeys{zone: name} // no trust anchor at all
+		ttl = maxZoneKeysTTL
+	default:
+		var parent zoneKeys
+		parent, err = s.zoneFor(ctx, parentName(name))
+		if err != nil {
+			return zoneKeys{}, err
+		}
+		zk, ttl, err = s.delegation(ctx, name, parent)
+	}
+	if err != nil {
+		return zoneKeys{}, err
+	}
+
+	if ttl < minZoneKeysTTL {
+		ttl = minZoneKeysTTL
+	}
+	if ttl > maxZoneKeysTTL {
+		ttl = maxZoneKeysTTL
+	}
+	zk.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	v.Lock()
+	if len(v.zones) >= maxZoneKeys {
+		v.zones = make(map[string]zoneKeys)
+	}
+	v.zones[name] = zk
+	v.Unlock()
+	return zk, nil
+}
+
+// delegation looks up the DS records of name in the zone parent. If there
+// are any, name is a secure zone of its own. If parent proves that name is
+// a delegation without them, name is insecure. Otherwise name belongs to
+// parent.
+func (s *Server) delegation(ctx context.Context, name string, parent zoneKeys) (zoneKeys, uint32, error) {
+	if parent.keys == nil {
+		return parent, maxZoneKeysTTL, nil
+	}
+	r, err := s.dnssecQuery(ctx, name, dns.TypeDS)
+	if err != nil {
+		return zoneKeys{}, 0, err
+	}
+
+	sets, sigs := splitRRsets(r.Answer)
+	for _, set := range sets {
+		if set[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(set[0].Header().Name, name) {
+			continue
+		}
+		if _, err := verifyRRset(set, sigsFor(sigs, name, dns.TypeDS), parent); err != nil {
+			return zoneKeys{}, 0, err
+		}
+		if !anySupported(set) {
+			return zoneKeys{zone: name}, set[0].Header().Ttl, nil
+		}
+		keys, ttl, err := s.fetchKeys(ctx, name, set)
+		if err != nil {
+			return zoneKeys{}, 0, err
+		}
+		return zoneKeys{zone: name, keys: keys}, ttl, nil
+	}
+
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return zoneKeys{}, 0, &fetchError{name: name, qtype: dns.TypeDS, err: errors.New(dns.RcodeToString[r.Rcode])}
+	}
+	if err := s.validateAuthority(r.Ns, parent); err != nil {
+		return zoneKeys{}, 0, err
+	}
+	if insecureDelegation(r.Ns, name) {
+		return zoneKeys{zone: name}, negativeTTL(r.Ns), nil
+	}
+	return parent, negativeTTL(r.Ns), nil
+}
+
+// fetchKeys looks up the DNSKEY records of zone and returns them if they are
+// signed by a key that matches one of the DS or DNSKEY records in trusted.
+func (s *Server) fetchKeys(ctx context.Context, zone string, trusted []dns.RR) ([]*dns.DNSKEY, uint32, error) {
+	r, err := s.dnssecQuery(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	var set []dns.RR
+	var keys []*dns.DNSKEY
+	for _, rr := range r.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			set = append(set, key)
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("%w: no DNSKEY records for %s", errBogus, zone)
+	}
+
+	var anchored []*dns.DNSKEY
+	for _, key := range keys {
+		if matchesAnchor(key, trusted) {
+			anchored = append(anchored, key)
+		}
+	}
+	_, sigs := splitRRsets(r.Answer)
+	if _, err := verifyRRset(set, sigsFor(sigs, zone, dns.TypeDNSKEY), zoneKeys{zone: zone, keys: anchored}); err != nil {
+		return nil, 0, err
+	}
+	return keys, set[0].Header().Ttl, nil
+}
+
+// dnssecQuery looks up the records of name needed for validation. Failing
+// nameservers, including those that answer with SERVFAIL, give a *fetchError.
+func (s *Server) dnssecQuery(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, true)
+	req.CheckingDisabled = true
+	r, err := s.forwardUpstream(ctx, req, false)
+	if err == nil && r.Rcode == dns.RcodeServerFailure {
+		err = errors.New(dns.RcodeToString[r.Rcode])
+	}
+	if err != nil {
+		return nil, &fetchError{name: name, qtype: qtype, err: err}
+	}
+	return r, nil
+}
+
+// dnssecReply removes what a client did not ask for from an answer that
+// was validated: the DNSSEC records and AD bit without the DO bit, and the
+// OPT record of the upstream query without EDNS.
+func (s *Server) dnssecReply(req, m *dns.Msg) {
+	if !s.config.DNSSEC {
+		return
+	}
+	opt := req.IsEdns0()
+	if opt == nil || !opt.Do() {
+		qtype := req.Question[0].Qtype
+		m.Answer = stripDNSSEC(m.Answer, qtype)
+		m.Ns = stripDNSSEC(m.Ns, 0)
+		m.Extra = stripDNSSEC(m.Extra, 0)
+		if !req.AuthenticatedData {
+			m.AuthenticatedData = false
+		}
+	}
+	if opt == nil {
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+	} else if o := m.IsEdns0(); o != nil && !opt.Do() {
+		o.SetDo(false)
+	}
+}
+
+// isBogus reports whether m is the SERVFAIL for an answer that failed validation.
+func isBogus(m *dns.Msg) bool {
+	if m.Rcode != dns.RcodeServerFailure {
+		return false
+	}
+	if o := m.IsEdns0(); o != nil {
+		for _, e := range o.Option {
+			if ede, ok := e.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeDNSBogus {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stripDNSSEC(rrs []dns.RR, keep uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != keep {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// verifyRRset checks that one of sigs is a valid signature of set made by
+// one of the keys of zk and returns it.
+func verifyRRset(set []dns.RR, sigs []*dns.RRSIG, zk zoneKeys) (*dns.RRSIG, error) {
+	now := time.Now()
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, zk.zone) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range zk.keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set) == nil {
+				return sig, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no valid signature of %s %s by %s", errBogus,
+		set[0].Header().Name, dns.TypeToString[set[0].Header().Rrtype], zk.zone)
+}
+
+// matchesAnchor reports whether key is one of the DS or DNSKEY records in trusted.
+func matchesAnchor(key *dns.DNSKEY, trusted []dns.RR) bool {
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *dns.DS:
+			if t.KeyTag != key.KeyTag() || t.Algorithm != key.Algorithm {
+				continue
+			}
+			if ds := key.ToDS(t.DigestType); ds != nil && strings.EqualFold(ds.Digest, t.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if t.Algorithm == key.Algorithm && t.PublicKey == key.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anySupported(dsSet []dns.RR) bool {
+	for _, rr := range dsSet {
+		if ds, ok := rr.(*dns.DS); ok && supportedAlgorithms[ds.Algorithm] {
+			switch ds.DigestType {
+			case dns.SHA1, dns.SHA256, dns.SHA384:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provesDenial reports whether the NSEC or NSEC3 records in ns prove that
+// name does not exist or has no records of qtype. Either proof includes
+// that no wildcard could have answered the query instead (RFC 4035 section
+// 5.4, RFC 5155 section 8).
+func provesDenial(ns []dns.RR, name string, qtype uint16, nxdomain bool) bool {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range ns {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, t)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, t)
+		}
+	}
+	if len(nsec3s) > 0 {
+		return nsec3Denial(nsec3s, name, qtype, nxdomain)
+	}
+	return nsecDenial(nsecs, name, qtype, nxdomain)
+}
+
+// nsecDenial is provesDenial for NSEC records. The NSEC record that covers
+// name proves its closest encloser, the wildcard there must not exist or,
+// for NODATA, must have no records of qtype either.
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if strings.EqualFold(n.Hdr.Name, name) {
+				return noData(n.TypeBitMap, qtype)
+			}
+		}
+	}
+	for _, n := range nsecs {
+		if !nsecCovers(n, name) {
+			continue
+		}
+		if !nxdomain && dns.IsSubDomain(strings.ToLower(name), strings.ToLower(n.NextDomain)) {
+			return true // an empty non-terminal
+		}
+		wildcard := wildcardAt(nsecEncloser(n, name))
+		for _, w := range nsecs {
+			if nxdomain && nsecCovers(w, wildcard) {
+				return true
+			}
+			if !nxdomain && strings.EqualFold(w.Hdr.Name, wildcard) && noData(w.TypeBitMap, qtype) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsec3Denial is provesDenial for NSEC3 records. Without an NSEC3 record
+// matching name, it takes the closest encloser proof and a proof that the
+// wildcard at the closest encloser does not exist or, for NODATA, has no
+// records of qtype either.
+func nsec3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, n := range nsec3s {
+			if n.Match(name) {
+				return noData(n.TypeBitMap, qtype)
+			}
+		}
+	}
+	ce, nextCloser := nsec3Encloser(nsec3s, name)
+	if nextCloser == nil {
+		return false
+	}
+	if !nxdomain && qtype == dns.TypeDS && nextCloser.Flags&1 == 1 {
+		return true // an insecure delegation in an opt-out span
+	}
+	wildcard := wildcardAt(ce)
+	for _, n := range nsec3s {
+		if nxdomain && nsec3Covers(n, wildcard) {
+			return true
+		}
+		if !nxdomain && n.Match(wildcard) && noData(n.TypeBitMap, qtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Encloser returns the closest encloser of name proven by nsec3s and
+// the NSEC3 record that covers the next closer name (RFC 5155 section 8.3).
+// The record is nil if there is no such proof.
+func nsec3Encloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := 1; i <= len(labels); i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		matched := false
+		for _, n := range nsec3s {
+			if n.Match(ce) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		for _, n := range nsec3s {
+			if nsec3Covers(n, nextCloser) {
+				return ce, n
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// provesNoCloserMatch reports whether the NSEC or NSEC3 records in ns prove
+// that name, which was answered from the wildcard at its closest encloser
+// ce, does not exist itself (RFC 4035 section 5.3.4, RFC 5155 section 8.8).
+func provesNoCloserMatch(ns []dns.RR, name, ce string) bool {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(ce)-1:], "."))
+	for _, rr := range ns {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(t, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nsec3Covers(t, nextCloser) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// noData reports whether the type bitmap of an NSEC or NSEC3 record proves
+// that its owner has no records of qtype. The bitmap of a delegation only
+// speaks for the parent side, the DS records.
+func noData(bitmap []uint16, qtype uint16) bool {
+	if hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) && qtype != dns.TypeDS {
+		return false
+	}
+	return !hasType(bitmap, qtype) && !hasType(bitmap, dns.TypeCNAME)
+}
+
+// insecureDelegation reports whether the NSEC or NSEC3 records in ns prove
+// that name is a delegation without DS records, or that it may be one in an
+// opt-out span (RFC 5155 section 8.6).
+func insecureDelegation(ns []dns.RR, name string) bool {
+	var nsec3s []*dns.NSEC3
+	for _, rr := range ns {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(t.Hdr.Name, name) &&
+				hasType(t.TypeBitMap, dns.TypeNS) && !hasType(t.TypeBitMap, dns.TypeDS) && !hasType(t.TypeBitMap, dns.TypeSOA) {
+				return true
+			}
+		case *dns.NSEC3:
+			if t.Match(name) && hasType(t.TypeBitMap, dns.TypeNS) && !hasType(t.TypeBitMap, dns.TypeDS) && !hasType(t.TypeBitMap, dns.TypeSOA) {
+				return true
+			}
+			nsec3s = append(nsec3s, t)
+		}
+	}
+	_, nextCloser := nsec3Encloser(nsec3s, name)
+	return nextCloser != nil && nextCloser.Flags&1 == 1
+}
+
+// nsecCovers reports whether name falls between the owner and next name of nsec.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of the zone wraps around to the apex
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(strings.ToLower(next), strings.ToLower(name))
+}
+
+// wildcardAt returns the name of the wildcard that is a child of ce.
+func wildcardAt(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// nsecEncloser returns the closest encloser of name proven by the NSEC
+// record that covers it: the longest of the ancestors name shares with the
+// owner and the next name of nsec.
+func nsecEncloser(nsec *dns.NSEC, name string) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	n := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// nsec3Covers reports whether the hash of name falls between the owner and
+// next hash of nsec3. Unlike Cover, it is false if the hashes are equal.
+func nsec3Covers(nsec3 *dns.NSEC3, name string) bool {
+	return nsec3.Cover(name) && !nsec3.Match(name)
+}
+
+// canonicalCompare orders names as described in RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRRset(rrs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// negativeTTL returns the TTL of the SOA record of a negative answer.
+func negativeTTL(ns []dns.RR) uint32 {
+	for _, rr := range ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return minZoneKeysTTL
+}
+
+// splitRRsets groups rrs into RRsets and returns them apart from the signatures.
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, []*dns.RRSIG) {
+	var sets [][]dns.RR
+	var sigs []*dns.RRSIG
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		switch t := rr.(type) {
+		case *dns.RRSIG:
+			sigs = append(sigs, t)
+			continue
+		case *dns.OPT:
+			continue
+		}
+		h := rr.Header()
+		key := strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets, sigs
+}
+
+// sigsFor returns the signatures in sigs that cover the RRset name/rrtype.
+func sigsFor(sigs []*dns.RRSIG, name string, rrtype uint16) []*dns.RRSIG {
+	var out []*dns.RRSIG
+	for _, sig := range sigs {
+		if sig.TypeCovered == rrtype && strings.EqualFold(sig.Hdr.Name, name) {
+			out = append(out, sig)
+		}
+	}
+	return out
+}
+
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+// signedZone signs records with a single ECDSA key.
+type signedZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newSignedZone(t *testing.T, name string) *signedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signedZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the records given in zone file syntax with their signature.
+func (z *signedZone) sign(t *testing.T, records ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return append(rrs, z.sig(t, rrs))
+}
+
+func (z *signedZone) sig(t *testing.T, rrset []dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func (z *signedZone) dnskey() []dns.RR {
+	return []dns.RR{z.key}
+}
+
+func (z *signedZone) ds() string {
+	return z.key.ToDS(dns.SHA256).String()
+}
+
+func (z *signedZone) soa() string {
+	return z.name + " 60 IN SOA ns." + z.name + " hostmaster." + z.name + " 1 1800 900 604800 60"
+}
+
+// signedUpstream answers name/type from answers, with the authority section
+// from authority, and any other query for a name from negative, which holds
+// the rcode and authority section. Queries for name/type in silent are not
+// answered.
+type signedUpstream struct {
+	answers   map[string][]dns.RR
+	authority map[string][]dns.RR
+	negative  map[string][]dns.RR
+	nxdomain  map[string]bool
+	silent    map[string]bool
+}
+
+func (u *signedUpstream) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	if u.silent[strings.ToLower(q.Name)+"/"+dns.TypeToString[q.Qtype]] {
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetEdns0(4096, true)
+	name := strings.ToLower(q.Name)
+	if rrs, ok := u.answers[name+"/"+dns.TypeToString[q.Qtype]]; ok {
+		m.Answer = rrs
+		m.Ns = u.authority[name]
+	} else {
+		m.Ns = u.negative[name]
+		if u.nxdomain[name] {
+			m.Rcode = dns.RcodeNameError
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	root := newSignedZone(t, ".")
+	tld := newSignedZone(t, "test.")
+	example := newSignedZone(t, "example.test.")
+
+	key := func(z *signedZone) []dns.RR { return append(z.dnskey(), z.sig(t, z.dnskey())) }
+	bogusA := example.sign(t, "bogus.example.test. 300 IN A 10.0.0.2")
+	bogusA[0].(*dns.A).A = bogusA[0].(*dns.A).A.To4()
+	bogusA[0].(*dns.A).A[3] = 66
+	forgedA := example.sign(t, "forged.example.test. 300 IN A 10.0.0.5")
+	forgedA[0].(*dns.A).A = forgedA[0].(*dns.A).A.To4()
+	forgedA[0].(*dns.A).A[3] = 66
+
+	// wild.example.test. and nowild.example.test. are answered from
+	// *.example.test., only the first with the proof that it does not exist.
+	wildcard := func(name string) []dns.RR {
+		rrs := example.sign(t, "*.example.test. 300 IN A 10.0.0.6")
+		rrs[0].Header().Name, rrs[1].Header().Name = name, name
+		return rrs
+	}
+	// The NSEC records of the zone, without *.example.test.
+	apexNSEC := example.sign(t, "example.test. 300 IN NSEC bogus.example.test. NS SOA RRSIG NSEC DNSKEY")
+	bogusNSEC := example.sign(t, "bogus.example.test. 300 IN NSEC www.example.test. A RRSIG NSEC")
+
+	u := &signedUpstream{
+		answers: map[string][]dns.RR{
+			"./DNSKEY":                 key(root),
+			"test./DS":                 root.sign(t, tld.ds()),
+			"test./DNSKEY":             key(tld),
+			"example.test./DS":         tld.sign(t, example.ds()),
+			"example.test./DNSKEY":     key(example),
+			"www.example.test./A":      example.sign(t, "www.example.test. 300 IN A 10.0.0.1"),
+			"bogus.example.test./A":    bogusA,
+			"stripped.example.test./A": {mustRR(t, "stripped.example.test. 300 IN A 10.0.0.3")},
+			"www.insecure.test./A":     {mustRR(t, "www.insecure.test. 300 IN A 10.0.0.4")},
+			"forged.example.test./A":   forgedA,
+			"wild.example.test./A":     wildcard("wild.example.test."),
+			"nowild.example.test./A":   wildcard("nowild.example.test."),
+		},
+		authority: map[string][]dns.RR{
+			"wild.example.test.": bogusNSEC,
+		},
+		negative: map[string][]dns.RR{
+			"www.example.test.": append(example.sign(t, example.soa()),
+				example.sign(t, "www.example.test. 300 IN NSEC zzz.example.test. A RRSIG NSEC")...),
+			"missing.example.test.": append(append(example.sign(t, example.soa()), bogusNSEC...), apexNSEC...),
+			// the proof that *.example.test. does not exist is missing
+			"nowild.example.test.": append(example.sign(t, example.soa()), bogusNSEC...),
+			"insecure.test.": append(tld.sign(t, tld.soa()),
+				tld.sign(t, "insecure.test. 300 IN NSEC zzz.test. NS RRSIG NSEC")...),
+		},
+		nxdomain: map[string]bool{"missing.example.test.": true, "nowild.example.test.": true},
+	}
+	upstream := startUDPServer(t, "127.0.0.1:0", u)
+
+	anchorFile := filepath.Join(t.TempDir(), "anchors")
+	if err := os.WriteFile(anchorFile, []byte(root.ds()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{
+		Nameservers:     []string{upstream},
+		DNSSEC:          true,
+		TrustAnchorFile: anchorFile,
+		ReadTimeout:     time.Second,
+		RCache:          10,
+		RCacheTtl:       time.Minute,
+	}, "", nil)
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantRcode int
+		wantAD    bool
+	}{
+		{name: "www.example.test.", qtype: dns.TypeA, wantAD: true},
+		{name: "www.example.test.", qtype: dns.TypeAAAA, wantAD: true},
+		{name: "missing.example.test.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantAD: true},
+		{name: "www.insecure.test.", qtype: dns.TypeA},
+		{name: "bogus.example.test.", qtype: dns.TypeA, wantRcode: dns.RcodeServerFailure},
+		{name: "stripped.example.test.", qtype: dns.TypeA, wantRcode: dns.RcodeServerFailure},
+		{name: "wild.example.test.", qtype: dns.TypeA, wantAD: true},
+		{name: "nowild.example.test.", qtype: dns.TypeA, wantRcode: dns.RcodeServerFailure},
+		{name: "nowild.example.test.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeServerFailure},
+	}
+	for _, tc := range tests {
+		desc := tc.name + " " + dns.TypeToString[tc.qtype]
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		req.AuthenticatedData = true // asks for the AD bit without DNSSEC records
+		w := NewWriter("udp", "127.0.0.1:0")
+		s.ServeDNS(w, req)
+		m := w.Msg()
+		if !assert.NotNil(t, m, desc) {
+			continue
+		}
+		assert.Equal(t, tc.wantRcode, m.Rcode, desc)
+		assert.Equal(t, tc.wantAD, m.AuthenticatedData, desc)
+		// The client did not ask for DNSSEC records or EDNS.
+		assert.Nil(t, m.IsEdns0(), desc)
+		for _, rr := range append(m.Answer, m.Ns...) {
+			assert.NotEqual(t, dns.TypeRRSIG, rr.Header().Rrtype, desc)
+		}
+	}
+
+	// A client with the DO bit set gets the signatures.
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.test.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	w := NewWriter("udp", "127.0.0.1:0")
+	s.ServeDNS(w, req)
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.True(t, m.AuthenticatedData)
+		assert.Len(t, m.Answer, 2)
+	}
+
+	// A client that sets the CD bit gets the answer without validation,
+	// which is not cached for the others.
+	req = new(dns.Msg)
+	req.SetQuestion("forged.example.test.", dns.TypeA)
+	req.CheckingDisabled = true
+	w = NewWriter("udp", "127.0.0.1:0")
+	s.ServeDNS(w, req)
+	if m := w.Msg(); assert.NotNil(t, m) && assert.Len(t, m.Answer, 1) {
+		assert.False(t, m.AuthenticatedData)
+		assert.Equal(t, "10.0.0.66", m.Answer[0].(*dns.A).A.String())
+	}
+	req.CheckingDisabled = false
+	w = NewWriter("udp", "127.0.0.1:0")
+	s.ServeDNS(w, req)
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+	}
+
+	// The bogus answer is cached with its result.
+	m := s.cacheHit(dns.Question{Name: "bogus.example.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1, nil)
+	if assert.NotNil(t, m) {
+		assert.True(t, isBogus(m))
+	}
+}
+
+func TestDNSSECKeyTimeout(t *testing.T) {
+	root := newSignedZone(t, ".")
+	u := &signedUpstream{
+		answers: map[string][]dns.RR{"www.test./A": root.sign(t, "www.test. 300 IN A 10.0.0.1")},
+		silent:  map[string]bool{"./DNSKEY": true},
+	}
+	upstream := startUDPServer(t, "127.0.0.1:0", u)
+
+	anchorFile := filepath.Join(t.TempDir(), "anchors")
+	if err := os.WriteFile(anchorFile, []byte(root.ds()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{
+		Nameservers:     []string{upstream},
+		DNSSEC:          true,
+		TrustAnchorFile: anchorFile,
+		ReadTimeout:     100 * time.Millisecond,
+		RCache:          10,
+		RCacheTtl:       time.Minute,
+	}, "", nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.test.", dns.TypeA)
+	_, err := s.validatedQuery(context.Background(), req, false)
+	var fe *fetchError
+	assert.ErrorAs(t, err, &fe)
+
+	// The answer is not bogus, just not available for now.
+	w := NewWriter("udp", "127.0.0.1:0")
+	s.ServeDNS(w, req)
+	if m := w.Msg(); assert.NotNil(t, m) {
+		assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+		assert.False(t, isBogus(m))
+	}
+	assert.Nil(t, s.cacheHit(req.Question[0], false, false, 1, nil))
+}
+
+func TestLoadTrustAnchors(t *testing.T) {
+	anchors, err := loadTrustAnchors("")
+	if assert.NoError(t, err) {
+		assert.Len(t, anchors, 2)
+	}
+	_, err = loadTrustAnchors(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	for i := 1; i < len(ordered); i++ {
+		assert.Less(t, canonicalCompare(ordered[i-1], ordered[i]), 0, ordered[i])
+	}
+}
+
+// nsec3Chain returns the NSEC3 records of zone for the names with the
+// given types.
+func nsec3Chain(zone string, flags uint8, names map[string][]uint16) []dns.RR {
+	var hashes []string
+	types := make(map[string][]uint16)
+	for name, bitmap := range names {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, h)
+		types[h] = bitmap
+	}
+	sort.Strings(hashes)
+	var chain []dns.RR
+	for i, h := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types[h],
+		})
+	}
+	return chain
+}
+
+func TestProvesDenial(t *testing.T) {
+	nsec := []dns.RR{
+		mustRR(t, "example.test. 300 IN NSEC a.example.test. NS SOA RRSIG NSEC DNSKEY"),
+		mustRR(t, "a.example.test. 300 IN NSEC *.wild.example.test. A RRSIG NSEC"),
+		mustRR(t, "*.wild.example.test. 300 IN NSEC x.y.example.test. TXT RRSIG NSEC"),
+		mustRR(t, "x.y.example.test. 300 IN NSEC example.test. A RRSIG NSEC"),
+	}
+	nsec3 := nsec3Chain("example.test.", 0, map[string][]uint16{
+		"example.test.":        {dns.TypeNS, dns.TypeSOA},
+		"a.example.test.":      {dns.TypeA},
+		"wild.example.test.":   {},
+		"*.wild.example.test.": {dns.TypeTXT},
+		"y.example.test.":      {},
+		"x.y.example.test.":    {dns.TypeA},
+	})
+
+	tests := []struct {
+		desc     string
+		name     string
+		qtype    uint16
+		nxdomain bool
+		want     bool
+	}{
+		{desc: "nodata", name: "a.example.test.", qtype: dns.TypeAAAA, want: true},
+		{desc: "existing type", name: "a.example.test.", qtype: dns.TypeA},
+		{desc: "nxdomain", name: "b.example.test.", qtype: dns.TypeA, nxdomain: true, want: true},
+		{desc: "nxdomain below a wildcard", name: "b.wild.example.test.", qtype: dns.TypeA, nxdomain: true},
+		{desc: "wildcard nodata", name: "b.wild.example.test.", qtype: dns.TypeA, want: true},
+		{desc: "wildcard with the type", name: "b.wild.example.test.", qtype: dns.TypeTXT},
+		{desc: "empty non-terminal", name: "y.example.test.", qtype: dns.TypeA, want: true},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, provesDenial(nsec, tc.name, tc.qtype, tc.nxdomain), "NSEC "+tc.desc)
+		assert.Equal(t, tc.want, provesDenial(nsec3, tc.name, tc.qtype, tc.nxdomain), "NSEC3 "+tc.desc)
+	}
+
+	// Only the name itself is not enough for NXDOMAIN.
+	assert.False(t, provesDenial(nsec[1:2], "b.example.test.", dns.TypeA, true))
+
+	// An answer from *.wild.example.test. needs the proof that the name
+	// does not exist.
+	for _, ns := range [][]dns.RR{nsec, nsec3} {
+		assert.True(t, provesNoCloserMatch(ns, "b.wild.example.test.", "wild.example.test."))
+		assert.False(t, provesNoCloserMatch(ns, "a.example.test.", "example.test."))
+	}
+}
+
+func TestInsecureDelegationOptOut(t *testing.T) {
+	names := map[string][]uint16{"test.": {dns.TypeNS, dns.TypeSOA}, "signed.test.": {dns.TypeNS, dns.TypeDS}}
+	assert.True(t, insecureDelegation(nsec3Chain("test.", 1, names), "unsigned.test."))
+	assert.False(t, insecureDelegation(nsec3Chain("test.", 1, names), "signed.test."))
+	assert.False(t, insecureDelegation(nsec3Chain("test.", 0, names), "unsigned.test."))
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// dohClients holds one HTTP client per DNS-over-HTTPS nameserver so that
+// each of them keeps its own pool of connections.
+type dohClients struct {
+	clients map[string]*http.Client
+	sync.Mutex
+}
+
+// exchangeHTTPS sends req to a DNS-over-HTTPS nameserver (RFC 8484).
+func (s *Server) exchangeHTTPS(ctx context.Context, req *dns.Msg, ns string, u upstream) (*dns.Msg, error) {
+	// Use a zero ID to make requests cache friendly, as the RFC suggests.
+	q := req.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var hreq *http.Request
+	if s.config.DoHMethod == http.MethodGet {
+		reqURL, err := url.Parse(u.url)
+		if err != nil {
+			return nil, err
+		}
+		values := reqURL.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		reqURL.RawQuery = values.Encode()
+		hreq, err = http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		hreq, err = http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		hreq.Header.Set("Content-Type", dohMediaType)
+	}
+	hreq.Header.Set("Accept", dohMediaType)
+
+	resp, err := s.dohClient(ns, u).Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status from %s: %s", u.url, resp.Status)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != dohMediaType {
+		return nil, fmt.Errorf("unexpected content type from %s: %s", u.url, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = req.Id
+	return r, nil
+}
+
+// dohClient returns the HTTP client for the DNS-over-HTTPS nameserver ns.
+func (s *Server) dohClient(ns string, u upstream) *http.Client {
+	s.dohClients.Lock()
+	defer s.dohClients.Unlock()
+	if c, ok := s.dohClients.clients[ns]; ok {
+		return c
+	}
+
+	dialer := &net.Dialer{Timeout: s.dnsTLSClient.ReadTimeout}
+	transport := &http.Transport{
+		TLSClientConfig:   s.dnsTLSClient.TLSConfig.Clone(),
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if u.addr != "" {
+				// Connect to the bootstrap address instead of resolving the
+				// host of the URL, which may well have to be resolved by us.
+				addr = u.addr
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	c := &http.Client{Transport: transport, Timeout: s.dnsTLSClient.ReadTimeout}
+	if s.dohClients.clients == nil {
+		s.dohClients.clients = make(map[string]*http.Client)
+	}
+	s.dohClients.clients[ns] = c
+	return c
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+// newDoHServer starts a DNS-over-HTTPS stand-in that answers every query
+// through h. It returns the server and a CA file trusting its certificate.
+func newDoHServer(t *testing.T, h dns.HandlerFunc, requests *int32) (*httptest.Server, string) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		var buf []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, err = io.ReadAll(r.Body)
+		}
+		req := new(dns.Msg)
+		if err != nil || req.Unpack(buf) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		rw := NewWriter("tcp", "127.0.0.1:0")
+		h(rw, req)
+		out, _ := rw.Msg().Pack()
+		// Media type parameters do not matter.
+		w.Header().Set("Content-Type", dohMediaType+"; charset=binary")
+		w.Write(out)
+	}))
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile
+}
+
+func TestForwardHTTPS(t *testing.T) {
+	var requests int32
+	srv, caFile := newDoHServer(t, answerA("10.0.0.2"), &requests)
+	port := srv.URL[strings.LastIndex(srv.URL, ":")+1:]
+
+	tests := []struct {
+		name       string
+		nameserver string
+		method     string
+	}{
+		{name: "post", nameserver: srv.URL + "/dns-query", method: http.MethodPost},
+		{name: "get", nameserver: srv.URL + "/dns-query", method: http.MethodGet},
+		{name: "bootstrap address", nameserver: "https://example.com:" + port + "/dns-query#127.0.0.1", method: http.MethodPost},
+	}
+
+	hostfile, _ := hosts.NewHostsfile("", &hosts.Config{})
+	for _, tc := range tests {
+		nameservers, err := CreateNameservers([]string{tc.nameserver})
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		config := &Config{
+			DnsAddr:     "127.0.0.1:53",
+			Nameservers: nameservers,
+			TLSCAFile:   caFile,
+			DoHMethod:   tc.method,
+			ReadTimeout: time.Second,
+			RCache:      10,
+			RCacheTtl:   time.Minute,
+		}
+		if !assert.NoError(t, CheckConfig(config), tc.name) {
+			continue
+		}
+		s := New(hostfile, config, "", nil)
+
+		before := atomic.LoadInt32(&requests)
+		for i := 0; i < 2; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			rw := NewWriter("udp", "127.0.0.1:0")
+			s.ServeDNS(rw, req)
+			m := rw.Msg()
+			assert.Equal(t, req.Id, m.Id, tc.name)
+			if assert.Len(t, m.Answer, 1, tc.name) {
+				assert.Equal(t, "10.0.0.2", m.Answer[0].(*dns.A).A.String(), tc.name)
+			}
+		}
+		// The second query is answered from the cache.
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests)-before, tc.name)
+	}
+}
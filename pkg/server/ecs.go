@@ -0,0 +1,204 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/soulteary/go-dnsmasq/pkg/cache"
+)
+
+// How the EDNS Client Subnet option (RFC 7871) of forwarded queries is set.
+const (
+	ECSPass  = "pass"  // forward the option the client sent, if any
+	ECSAdd   = "add"   // send the subnet of the client's source address
+	ECSStrip = "strip" // never send the option
+)
+
+// clientSubnet returns the client subnet option sent upstream for req from w,
+// or nil if none is sent.
+func (s *Server) clientSubnet(w dns.ResponseWriter, req *dns.Msg) *dns.EDNS0_SUBNET {
+	switch s.config.ECSMode {
+	case ECSPass:
+		return findSubnet(req.IsEdns0())
+	case ECSAdd:
+		ip := remoteIP(w)
+		if ip == nil {
+			return nil
+		}
+		e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+		if ip4 := ip.To4(); ip4 != nil {
+			e.Family = 1
+			e.SourceNetmask = uint8(s.config.ECSPrefixV4)
+			e.Address = ip4.Mask(net.CIDRMask(s.config.ECSPrefixV4, 32))
+		} else {
+			e.Family = 2
+			e.SourceNetmask = uint8(s.config.ECSPrefixV6)
+			e.Address = ip.Mask(net.CIDRMask(s.config.ECSPrefixV6, 128))
+		}
+		return e
+	}
+	return nil
+}
+
+// ecsRequest returns req with its client subnet option replaced by subnet.
+// req is copied if it has to be changed.
+func (s *Server) ecsRequest(req *dns.Msg, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	if s.config.ECSMode != ECSAdd && s.config.ECSMode != ECSStrip {
+		return req
+	}
+	if subnet == nil && findSubnet(req.IsEdns0()) == nil {
+		return req
+	}
+	req = req.Copy()
+	o := req.IsEdns0()
+	if o == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		o = req.IsEdns0()
+	}
+	removeSubnet(o)
+	if subnet != nil {
+		o.Option = append(o.Option, subnet)
+	}
+	return req
+}
+
+// ecsReply removes the client subnet option from m unless the client sent one
+// that was passed on. EDNS is removed altogether if the client did not use it.
+// A passed on option is answered with the client's own, which carries the
+// scope of m: m may be cached from a query for another subnet in that scope,
+// which the client would reject (RFC 7871 section 7.3).
+func (s *Server) ecsReply(req, m *dns.Msg) {
+	clientOpt := req.IsEdns0()
+	if clientOpt == nil {
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+		return
+	}
+	o := m.IsEdns0()
+	if o == nil {
+		return
+	}
+	client := findSubnet(clientOpt)
+	if s.config.ECSMode == ECSPass && client != nil {
+		reply := *client
+		reply.SourceScope = ecsScope(m)
+		removeSubnet(o)
+		o.Option = append(o.Option, &reply)
+		return
+	}
+	removeSubnet(o)
+}
+
+// ecsCacheKey extends the cache key of an answer for a client in subnet that
+// is valid for the given scope prefix length.
+func ecsCacheKey(key string, subnet *dns.EDNS0_SUBNET, scope uint8) string {
+	if subnet == nil {
+		return key
+	}
+	if scope > subnet.SourceNetmask {
+		scope = subnet.SourceNetmask
+	}
+	return cache.KeySubnet(key, subnet.Address, scope)
+}
+
+// ecsScope returns the scope prefix length of the client subnet option in m.
+func ecsScope(m *dns.Msg) uint8 {
+	if e := findSubnet(m.IsEdns0()); e != nil {
+		return e.SourceScope
+	}
+	return 0
+}
+
+func findSubnet(o *dns.OPT) *dns.EDNS0_SUBNET {
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func removeSubnet(o *dns.OPT) {
+	options := o.Option[:0]
+	for _, opt := range o.Option {
+		if _, ok := opt.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, opt)
+		}
+	}
+	o.Option = options
+}
+
+// ecsScopes remembers the scope prefix lengths of cached answers, so that a
+// lookup only has to try the keys answers can actually be stored under.
+type ecsScopes struct {
+	lengths map[uint16][]uint8 // by address family, longest first
+	sync.RWMutex
+}
+
+func (e *ecsScopes) add(family uint16, scope uint8) {
+	e.Lock()
+	defer e.Unlock()
+	for _, l := range e.lengths[family] {
+		if l == scope {
+			return
+		}
+	}
+	if e.lengths == nil {
+		e.lengths = make(map[uint16][]uint8)
+	}
+	// A new slice, the old one may be in use by lookups.
+	lengths := append(append([]uint8(nil), e.lengths[family]...), scope)
+	sort.Slice(lengths, func(i, j int) bool { return lengths[i] > lengths[j] })
+	e.lengths[family] = lengths
+}
+
+func (e *ecsScopes) get(family uint16) []uint8 {
+	e.RLock()
+	defer e.RUnlock()
+	return e.lengths[family]
+}
+
+// cacheHit looks up the cached answer to q for a client in subnet.
+func (s *Server) cacheHit(q dns.Question, dnssec, tcp bool, msgid uint16, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	m, _ := s.cacheHitKey(q, dnssec, tcp, msgid, subnet)
+	return m
+}
+
+// cacheHitKey is like cacheHit and also returns the key of the answer.
+func (s *Server) cacheHitKey(q dns.Question, dnssec, tcp bool, msgid uint16, subnet *dns.EDNS0_SUBNET) (*dns.Msg, string) {
+	key := cache.Key(q, dnssec, tcp)
+	if subnet == nil {
+		return s.rcache.HitKey(key, msgid), key
+	}
+	for _, scope := range s.ecsScopes.get(subnet.Family) {
+		k := ecsCacheKey(key, subnet, scope)
+		if m := s.rcache.HitKey(k, msgid); m != nil {
+			return m, k
+		}
+	}
+	return nil, ""
+}
+
+// cacheInsert caches the answer m to q for a client in subnet.
+func (s *Server) cacheInsert(q dns.Question, dnssec, tcp bool, m *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	key := cache.Key(q, dnssec, tcp)
+	if subnet != nil {
+		scope := ecsScope(m)
+		if scope > subnet.SourceNetmask {
+			scope = subnet.SourceNetmask
+		}
+		s.ecsScopes.add(subnet.Family, scope)
+		key = ecsCacheKey(key, subnet, scope)
+	}
+	s.rcache.InsertMessage(key, m)
+}
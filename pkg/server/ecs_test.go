@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+// ecsHandler answers with an address derived from the client subnet of the
+// query and the given scope. Queries without a subnet get 10.255.255.255.
+func ecsHandler(scope uint8, requests *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(requests, 1)
+		ip := net.IPv4(10, 255, 255, 255)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if e := findSubnet(req.IsEdns0()); e != nil {
+			a := e.Address.To4().Mask(net.CIDRMask(int(scope), 32))
+			ip = net.IPv4(10, a[0], a[1], a[2])
+			m.SetEdns0(4096, false)
+			m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: e.SourceNetmask, SourceScope: scope, Address: e.Address,
+			}}
+		}
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   ip,
+		}}
+		w.WriteMsg(m)
+	}
+}
+
+func newECSServer(t *testing.T, mode string, scope uint8, requests *int32) *Server {
+	upstream := startUDPServer(t, "127.0.0.1:0", ecsHandler(scope, requests))
+	hostfile, _ := hosts.NewHostsfile("", &hosts.Config{})
+	config := &Config{
+		DnsAddr:     "127.0.0.1:53",
+		Nameservers: []string{upstream},
+		ECSMode:     mode,
+		ReadTimeout: time.Second,
+		RCache:      10,
+		RCacheTtl:   time.Minute,
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	return New(hostfile, config, "", nil)
+}
+
+func queryFrom(s *Server, client string, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if subnet != nil {
+		req.SetEdns0(4096, false)
+		req.IsEdns0().Option = []dns.EDNS0{subnet}
+	}
+	rw := NewWriter("udp", client)
+	s.ServeDNS(rw, req)
+	return rw.Msg()
+}
+
+func answerOf(m *dns.Msg) string {
+	if len(m.Answer) != 1 {
+		return ""
+	}
+	return m.Answer[0].(*dns.A).A.String()
+}
+
+func TestECSAdd(t *testing.T) {
+	var requests int32
+	s := newECSServer(t, ECSAdd, 24, &requests)
+
+	m := queryFrom(s, "192.0.2.1:1234", nil)
+	assert.Equal(t, "10.192.0.2", answerOf(m))
+	assert.Nil(t, m.IsEdns0(), "client did not use EDNS")
+
+	assert.Equal(t, "10.198.51.100", answerOf(queryFrom(s, "198.51.100.1:1234", nil)))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Same /24 as the first client: answered from the cache.
+	assert.Equal(t, "10.192.0.2", answerOf(queryFrom(s, "192.0.2.77:1234", nil)))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func clientSubnet(addr string) *dns.EDNS0_SUBNET {
+	return &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(addr).To4(),
+	}
+}
+
+func TestECSPassAndStrip(t *testing.T) {
+	subnet := func() *dns.EDNS0_SUBNET { return clientSubnet("203.0.113.0") }
+
+	var requests int32
+	s := newECSServer(t, ECSPass, 24, &requests)
+	m := queryFrom(s, "192.0.2.1:1234", subnet())
+	assert.Equal(t, "10.203.0.113", answerOf(m))
+	if e := findSubnet(m.IsEdns0()); assert.NotNil(t, e) {
+		assert.Equal(t, uint8(24), e.SourceScope)
+	}
+	// Without a subnet the client gets its own answer.
+	assert.Equal(t, "10.255.255.255", answerOf(queryFrom(s, "192.0.2.1:1234", nil)))
+
+	s = newECSServer(t, ECSStrip, 24, &requests)
+	m = queryFrom(s, "192.0.2.1:1234", subnet())
+	assert.Equal(t, "10.255.255.255", answerOf(m))
+	assert.Nil(t, findSubnet(m.IsEdns0()))
+}
+
+func TestECSPassScope(t *testing.T) {
+	var requests int32
+	s := newECSServer(t, ECSPass, 16, &requests)
+	assert.Equal(t, "10.203.0.0", answerOf(queryFrom(s, "192.0.2.1:1234", clientSubnet("203.0.113.0"))))
+
+	// A client in the same /16 gets the cached answer with its own subnet.
+	m := queryFrom(s, "192.0.2.2:1234", clientSubnet("203.0.200.0"))
+	assert.Equal(t, "10.203.0.0", answerOf(m))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	if e := findSubnet(m.IsEdns0()); assert.NotNil(t, e) {
+		assert.Equal(t, "203.0.200.0", e.Address.String())
+		assert.Equal(t, uint8(24), e.SourceNetmask)
+		assert.Equal(t, uint8(16), e.SourceScope)
+	}
+}
@@ -5,14 +5,43 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
-// ServeDNSForward resolves a query by forwarding to a recursive nameserver
+// defaultAttempts is the number of attempts per query when none is configured.
+const defaultAttempts = 2
+
+var errQueryDeadline = errors.New("query deadline exceeded")
+
+// ServeDNSForward resolves a query by forwarding to a recursive nameserver.
+// Identical queries that arrive while one is being forwarded share its answer.
+// The client subnet option of the reply is left for ServeDNS to deal with.
 func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	tcp := isTCP(w)
+	req = s.ecsRequest(req, s.clientSubnet(w, req))
+	return s.coalesce(req, tcp, func() *dns.Msg {
+		// The deadline covers the absolute lookups, the search and stub routing.
+		ctx := context.Background()
+		if s.config.QueryDeadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.config.QueryDeadline)
+			defer cancel()
+		}
+		m := s.serveDNSForward(ctx, req, tcp)
+		if s.dns64 != nil && req.Question[0].Qtype == dns.TypeAAAA {
+			m = s.forwardDNS64(ctx, req, m, tcp)
+		}
+		return m
+	})
+}
+
+func (s *Server) serveDNSForward(ctx context.Context, req *dns.Msg, tcp bool) *dns.Msg {
 	name := req.Question[0].Name
 	nameDots := dns.CountLabel(name) - 1
 	refuse := false
@@ -21,7 +50,7 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	case s.config.NoRec:
 		log.Printf("D! [%d] Refusing query, recursion disabled", req.Id)
 		refuse = true
-	case len(s.config.Nameservers) == 0:
+	case len(s.config.Nameservers) == 0 && !s.config.Recursive:
 		log.Printf("D! [%d] Refusing query, no nameservers configured", req.Id)
 		refuse = true
 	case nameDots < s.config.FwdNdots && !s.config.EnableSearch:
@@ -41,8 +70,6 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	var absoluteRes, searchRes *dns.Msg // responses from absolute/search lookups
 	var absoluteErr, searchErr error    // errors from absolute/search lookups
 
-	tcp := isTCP(w)
-
 	if s.config.EnableSearch && len(s.config.SearchDomains) > 0 {
 		searchEnabled = true
 	}
@@ -52,7 +79,7 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	if nameDots >= s.config.Ndots {
 		if nameDots >= s.config.FwdNdots {
 			log.Printf("D! [%d] Doing initial absolute lookup", req.Id)
-			absoluteRes, absoluteErr = s.forwardQuery(req, tcp)
+			absoluteRes, absoluteErr = s.forwardQuery(ctx, req, tcp)
 			if absoluteErr != nil {
 				log.Printf("E! [%d] Error looking up literal qname '%s' with upstreams: %v", req.Id, name, absoluteErr)
 			}
@@ -74,7 +101,7 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	// and we didn't previously fail to query the upstreams
 	if absoluteErr == nil && searchEnabled {
 		log.Printf("D! [%d] Doing search lookup", req.Id)
-		searchRes, searchErr = s.forwardSearch(req, tcp)
+		searchRes, searchErr = s.forwardSearch(ctx, req, tcp)
 		if searchErr != nil {
 			log.Printf("E! [%d] Error looking up qname '%s' with search: %v", req.Id, name, searchErr)
 		}
@@ -95,7 +122,7 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	if searchErr == nil && !didAbsolute {
 		if nameDots >= s.config.FwdNdots {
 			log.Printf("D! [%d] Doing absolute lookup", req.Id)
-			absoluteRes, absoluteErr = s.forwardQuery(req, tcp)
+			absoluteRes, absoluteErr = s.forwardQuery(ctx, req, tcp)
 			if absoluteErr != nil {
 				log.Printf("E! [%d] Error resolving literal qname '%s': %v", req.Id, name, absoluteErr)
 			}
@@ -115,7 +142,8 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 
 	// If we got here, we failed to get a positive result for the query.
 	// If we did an absolute query, return that result, otherwise return
-	// a no-data response with the rcode from the last search we did.
+	// the negative response of the last search we did. It keeps its SOA
+	// record, which tells how long it may be cached.
 	if didAbsolute && absoluteErr == nil {
 		log.Printf("D! [%d] Failed to resolve query. Returning response of absolute lookup: %s",
 			req.Id, dns.RcodeToString[absoluteRes.Rcode])
@@ -125,11 +153,11 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	}
 
 	if didSearch && searchErr == nil {
-		log.Printf("D! [%d] Failed to resolve query. Returning no-data response: %s",
+		log.Printf("D! [%d] Failed to resolve query. Returning response of search lookup: %s",
 			req.Id, dns.RcodeToString[searchRes.Rcode])
-		m := new(dns.Msg)
-		m.SetRcode(req, searchRes.Rcode)
-		return m
+		searchRes.Compress = true
+		searchRes.Id = req.Id
+		return searchRes
 	}
 
 	// If we got here, we either failed to forward the query or the qname was too
@@ -141,7 +169,7 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 }
 
 // forwardSearch resolves a query by suffixing with search paths
-func (s *Server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
+func (s *Server) forwardSearch(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	var r *dns.Msg
 	var nodata *dns.Msg   // stores the copy of a NODATA reply
 	var searchName string // stores the current name suffixed with search domain
@@ -156,9 +184,9 @@ func (s *Server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 		}
 
 		searchName = strings.ToLower(appendDomain(name, domain))
-		reqCopy.Question[0] = dns.Question{searchName, reqCopy.Question[0].Qtype, reqCopy.Question[0].Qclass}
+		reqCopy.Question[0] = dns.Question{Name: searchName, Qtype: reqCopy.Question[0].Qtype, Qclass: reqCopy.Question[0].Qclass}
 		didSearch = true
-		r, err = s.forwardQuery(reqCopy, tcp)
+		r, err = s.forwardQuery(ctx, reqCopy, tcp)
 		if err != nil {
 			// No Server currently available, give up
 			break
@@ -199,6 +227,7 @@ func (s *Server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 					answers = append(answers, rr)
 				}
 				r.Answer = answers
+				r.AuthenticatedData = false // the CNAME is not signed
 			}
 			// If we ever got a NODATA, return this instead of a negative result
 		} else if nodata != nil {
@@ -217,51 +246,128 @@ func (s *Server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	return r, err
 }
 
-// forwardQuery sends the query to nameservers retrying once on error
-func (s *Server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
+// forwardQuery resolves the query with the upstream nameservers and, with
+// DNSSEC enabled, validates the answer. Answers are checked for DNS
+// rebinding before anything caches them. Names in stub zones, including the
+// reverse zones, are neither validated nor checked for rebinding: they are
+// usually private and unsigned. Neither are they mirrored to the shadow
+// nameserver, nor is anything in recursive mode.
+func (s *Server) forwardQuery(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, error) {
+	var r *dns.Msg
+	var err error
+	_, srv, stub := s.stubs.lookup(req.Question[0].Name)
+	private := stub && (len(srv) == 0 || srv[0] != StubDefault)
+	if !private && !s.config.Recursive {
+		if shadow := s.mirror(req, tcp); shadow != nil {
+			defer func() { shadow.compare(r, err) }()
+		}
+	}
+	if !s.config.DNSSEC || private {
+		r, err = s.forwardUpstream(ctx, req, tcp)
+	} else {
+		r, err = s.validatedQuery(ctx, req, tcp)
+	}
+	if err == nil && s.config.StopDNSRebind && !private {
+		r = s.stopRebind(req, r)
+	}
+	return r, err
+}
+
+// forwardUpstream sends the query to nameservers, making up to the configured
+// number of attempts until ctx is done. Nameservers that are down are
+// skipped, the others are tried in the order of the upstream strategy. If
+// all of them fail or answer SERVFAIL, the fallback nameservers are tried.
+func (s *Server) forwardUpstream(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	var nservers []string // Nameservers to use for this query
-	var nsIdx int
 	var r *dns.Msg
 	var err error
 
 	nservers = s.config.Nameservers
-
-	// Check whether the name matches a stub zone
-	if s.config.Stub != nil {
-		for zone, srv := range s.config.Stub {
-			if strings.HasSuffix(req.Question[0].Name, zone) {
-				nservers = srv
-				StatsStubForwardCount.Inc(1)
-				break
-			}
+	recursive := s.config.Recursive
+	stub := false // stub zones have no fallback
+
+	// Check whether the name belongs to a stub zone
+	if zone, srv, ok := s.stubs.lookup(req.Question[0].Name); ok {
+		switch {
+		case len(srv) == 0:
+			log.Printf("D! [%d] Not forwarding qname '%s', stub zone %s is local only",
+				req.Id, req.Question[0].Name, zone)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			return m, nil
+		case srv[0] == StubDefault:
+			// exempt from any enclosing stub zone
+		default:
+			nservers = srv
+			recursive = false
+			stub = true
+			StatsStubForwardCount.Inc(1)
 		}
 	}
 
-	for try := 1; try <= 2; try++ {
+	if recursive {
+		return s.recurse(ctx, req)
+	}
+
+	r, err = s.forwardGroup(ctx, req, nservers, tcp)
+	fallback := s.config.FallbackNameservers
+	if len(fallback) == 0 || stub {
+		return r, err
+	}
+	if err == nil && r.Rcode != dns.RcodeServerFailure {
+		log.Printf("D! [%d] Primary nameservers answered qname '%s'", req.Id, req.Question[0].Name)
+		return r, err
+	}
+	if ctx.Err() != nil {
+		return r, err
+	}
+
+	log.Printf("E! [%d] All primary nameservers failed for qname '%s', failing over to %v",
+		req.Id, req.Question[0].Name, fallback)
+	StatsFailoverCount.Inc(1)
+	r, err = s.forwardGroup(ctx, req, fallback, tcp)
+	if err == nil {
+		log.Printf("D! [%d] Fallback nameservers answered qname '%s'", req.Id, req.Question[0].Name)
+	}
+	return r, err
+}
+
+// forwardGroup sends req to a group of nameservers, skipping those that
+// are down, until one of them gives a final answer or the attempts run out.
+func (s *Server) forwardGroup(ctx context.Context, req *dns.Msg, nservers []string, tcp bool) (*dns.Msg, error) {
+	var nsIdx int
+	var r *dns.Msg
+	var err error
+
+	// Skip nameservers that are down and order the others
+	nservers = s.orderUpstreams(s.health.available(nservers))
+
+	if s.config.UpstreamStrategy == StrategyAllServers {
+		return s.forwardAll(ctx, req, nservers, tcp)
+	}
+
+	attempts := s.config.Attempts
+	if attempts < 1 {
+		attempts = defaultAttempts
+	}
+	for try := 1; try <= attempts; try++ {
+		if ctx.Err() != nil {
+			log.Printf("D! [%d] Giving up on qname '%s', query deadline exceeded", req.Id, req.Question[0].Name)
+			if err == nil {
+				err = errQueryDeadline
+			}
+			break
+		}
 		log.Printf("D! [%d] Querying upstream %s for qname '%s'",
 			req.Id, nservers[nsIdx], req.Question[0].Name)
 
-		switch tcp {
-		case false:
-			r, _, err = s.dnsUDPClient.Exchange(req, nservers[nsIdx])
-		case true:
-			r, _, err = s.dnsTCPClient.Exchange(req, nservers[nsIdx])
-		}
+		start := time.Now()
+		r, err = s.exchange(ctx, req, nservers[nsIdx], tcp)
+		s.recordHealth(ctx, nservers[nsIdx], time.Since(start), err)
 
 		if err == nil {
 			log.Printf("D! [%d] Response code from upstream: %s", req.Id, dns.RcodeToString[r.Rcode])
-			switch r.Rcode {
-			// SUCCESS
-			case dns.RcodeSuccess:
-				fallthrough
-			case dns.RcodeNameError:
-				fallthrough
-			// NO RECOVERY
-			case dns.RcodeFormatError:
-				fallthrough
-			case dns.RcodeRefused:
-				fallthrough
-			case dns.RcodeNotImplemented:
+			if isFinalRcode(r.Rcode) {
 				return r, err
 			}
 		}
@@ -282,18 +388,54 @@ func (s *Server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	return r, err
 }
 
+// recordHealth records the outcome of a query to ns, unless it failed
+// because the query deadline was exceeded or the response did not match the
+// query. Such a response may be spoofed or stray, not from ns at all.
+func (s *Server) recordHealth(ctx context.Context, ns string, rtt time.Duration, err error) {
+	if err != nil && (ctx.Err() != nil || isMismatch(err)) {
+		return
+	}
+	s.health.record(ns, rtt, err)
+}
+
+// isMismatch reports whether err is about a response that does not match
+// its query.
+func isMismatch(err error) bool {
+	return errors.Is(err, dns.ErrId) || errors.Is(err, errCaseMismatch) || errors.Is(err, errCookieMismatch)
+}
+
 // ServeDNSReverse is the handler for DNS requests for the reverse zone. If nothing is found
-// locally the request is forwarded to the forwarder for resolution.
+// locally the request is forwarded to the forwarder for resolution, unless it
+// asks for a private address in bogus-priv mode that no stub zone routes.
 func (s *Server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.Compress = true
 	m.Authoritative = false
 	m.RecursionAvailable = true
+	if s.dns64 != nil {
+		if m := s.reverseDNS64(w, req); m != nil {
+			return m
+		}
+	}
 	if records, err := s.PTRRecords(req.Question[0]); err == nil && len(records) > 0 {
 		m.Answer = records
 		return m
 	}
-	// Always forward if not found locally.
+	if s.config.BogusPriv && s.isBogusPriv(req.Question[0].Name) {
+		log.Printf("D! [%d] Not forwarding reverse lookup of private address '%s'", req.Id, req.Question[0].Name)
+		m.SetRcode(req, dns.RcodeNameError)
+		return m
+	}
 	return s.ServeDNSForward(w, req)
 }
+
+// isBogusPriv reports whether name is the reverse lookup of a private
+// address that is not routed to a nameserver by a stub zone.
+func (s *Server) isBogusPriv(name string) bool {
+	if _, _, ok := privateReverse.lookup(name); !ok {
+		return false
+	}
+	_, servers, ok := s.stubs.lookup(name)
+	return !ok || isSpecialStub(servers)
+}
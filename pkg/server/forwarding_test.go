@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardAttempts(t *testing.T) {
+	var requests int32
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&requests, 1)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	}))
+
+	for _, attempts := range []int{1, 3} {
+		atomic.StoreInt32(&requests, 0)
+		s := New(nil, &Config{Nameservers: []string{upstream}, Attempts: attempts, ReadTimeout: time.Second}, "", nil)
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if assert.NoError(t, err) {
+			assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+		}
+		assert.Equal(t, int32(attempts), atomic.LoadInt32(&requests))
+	}
+}
+
+func TestForwardQueryDeadline(t *testing.T) {
+	// The upstream never answers, so every attempt runs into its timeout.
+	var requests int32
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	s := New(nil, &Config{
+		Nameservers:   []string{upstream},
+		EnableSearch:  true,
+		SearchDomains: []string{"a.test.", "b.test.", "c.test.", "d.test.", "e.test."},
+		Ndots:         1,
+		ReadTimeout:   100 * time.Millisecond,
+		Attempts:      2,
+		QueryDeadline: 250 * time.Millisecond,
+	}, "", nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.", dns.TypeA)
+	start := time.Now()
+	m := s.ServeDNSForward(NewWriter("udp", "127.0.0.1:0"), req)
+	elapsed := time.Since(start)
+
+	assert.Equal(t, dns.RcodeServerFailure, m.Rcode)
+	assert.Less(t, elapsed, 400*time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt32(&requests), int32(3))
+
+	// A timeout caused by the deadline does not count against the upstream.
+	assert.Equal(t, []string{upstream}, s.health.available(s.config.Nameservers))
+}
+
+func TestForwardFallback(t *testing.T) {
+	var fallbackQueries int32
+	servfail := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	}))
+	silent := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {}))
+	good := startUDPServer(t, "127.0.0.1:0", answerPTR("primary.example.com."))
+	fallback := startUDPServer(t, "127.0.0.1:0", countQueries(answerPTR("fallback.example.com."), &fallbackQueries))
+
+	tests := []struct {
+		primaries []string
+		wantPtr   string
+	}{
+		{primaries: []string{servfail, silent}, wantPtr: "fallback.example.com."},
+		{primaries: []string{servfail, good}, wantPtr: "primary.example.com."},
+	}
+	for _, tc := range tests {
+		atomic.StoreInt32(&fallbackQueries, 0)
+		s := New(nil, &Config{
+			Nameservers:         tc.primaries,
+			FallbackNameservers: []string{fallback},
+			Attempts:            2,
+			ReadTimeout:         100 * time.Millisecond,
+		}, "", nil)
+		req := new(dns.Msg)
+		req.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if assert.NoError(t, err, tc.wantPtr) && assert.Len(t, r.Answer, 1, tc.wantPtr) {
+			assert.Equal(t, tc.wantPtr, r.Answer[0].(*dns.PTR).Ptr)
+		}
+		if tc.wantPtr == "primary.example.com." {
+			assert.Equal(t, int32(0), atomic.LoadInt32(&fallbackQueries))
+		}
+	}
+}
+
+func TestForwardSearchNegative(t *testing.T) {
+	upstream := startUDPServer(t, "127.0.0.1:0", authServer(t,
+		"test. 300 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 60",
+	))
+	s := New(nil, &Config{
+		Nameservers:   []string{upstream},
+		EnableSearch:  true,
+		SearchDomains: []string{"a.test.", "b.test."},
+		Ndots:         1,
+		FwdNdots:      1,
+		ReadTimeout:   time.Second,
+	}, "", nil)
+
+	// The negative answer of the last search keeps its SOA record.
+	req := new(dns.Msg)
+	req.SetQuestion("host.", dns.TypeA)
+	m := s.ServeDNSForward(NewWriter("udp", "127.0.0.1:0"), req)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Equal(t, req.Id, m.Id)
+	assert.Equal(t, req.Question, m.Question)
+	if assert.Len(t, m.Ns, 1) {
+		assert.Equal(t, dns.TypeSOA, m.Ns[0].Header().Rrtype)
+	}
+}
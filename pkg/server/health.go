@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxUpstreamFailures is the number of consecutive failed queries after
+	// which a nameserver is considered down.
+	maxUpstreamFailures = 3
+	minProbeInterval    = time.Second
+	maxProbeInterval    = 5 * time.Minute
+)
+
+// upstreamHealth is the state of one nameserver.
+type upstreamHealth struct {
+	failures int           // consecutive failed queries
+	down     bool          // skipped by queries until a probe succeeds
+	backoff  time.Duration // time until the next probe
+	latency  time.Duration // exponentially weighted moving average of the response time
+	gauge    Gauge         // 1 when healthy, 0 when down
+}
+
+// healthTracker counts the failures of nameservers and takes those that keep
+// failing out of rotation. A down nameserver is probed with exponential
+// backoff until it answers again.
+type healthTracker struct {
+	upstreams  map[string]*upstreamHealth
+	probe      func(ns string) error
+	minBackoff time.Duration
+	sync.Mutex
+}
+
+func newHealthTracker(probe func(ns string) error) *healthTracker {
+	return &healthTracker{
+		upstreams:  make(map[string]*upstreamHealth),
+		probe:      probe,
+		minBackoff: minProbeInterval,
+	}
+}
+
+// get returns the state of ns. Must be called under the lock.
+func (h *healthTracker) get(ns string) *upstreamHealth {
+	u, ok := h.upstreams[ns]
+	if !ok {
+		u = &upstreamHealth{gauge: NewUpstreamGauge(ns)}
+		u.gauge.Update(1)
+		h.upstreams[ns] = u
+	}
+	return u
+}
+
+// available returns the nameservers that are not down, in their original order.
+// If all of them are down, all of them are returned as a last resort.
+func (h *healthTracker) available(nservers []string) []string {
+	h.Lock()
+	defer h.Unlock()
+	healthy := make([]string, 0, len(nservers))
+	for _, ns := range nservers {
+		if u, ok := h.upstreams[ns]; !ok || !u.down {
+			healthy = append(healthy, ns)
+		}
+	}
+	if len(healthy) == 0 {
+		return nservers
+	}
+	return healthy
+}
+
+// latencies returns the average response time of each of nservers.
+// Nameservers that have not been queried yet have a latency of zero.
+func (h *healthTracker) latencies(nservers []string) map[string]time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	latencies := make(map[string]time.Duration, len(nservers))
+	for _, ns := range nservers {
+		if u, ok := h.upstreams[ns]; ok {
+			latencies[ns] = u.latency
+		}
+	}
+	return latencies
+}
+
+// record updates the state of ns with the outcome of a query that took rtt.
+func (h *healthTracker) record(ns string, rtt time.Duration, err error) {
+	h.Lock()
+	defer h.Unlock()
+	u := h.get(ns)
+	if err == nil {
+		u.failures = 0
+		if u.latency == 0 {
+			u.latency = rtt
+		} else {
+			u.latency += (rtt - u.latency) / 4
+		}
+		return
+	}
+
+	// Errors can be quick (e.g. connection refused), so make sure a
+	// failing nameserver never looks faster than before.
+	if u.latency < rtt {
+		u.latency = rtt
+	}
+	if u.latency *= 2; u.latency > maxProbeInterval {
+		u.latency = maxProbeInterval
+	}
+
+	StatsUpstreamFailureCount.Inc(1)
+	u.failures++
+	if u.failures < maxUpstreamFailures || u.down {
+		return
+	}
+
+	log.Printf("E! Nameserver %s failed %d times in a row, marking it as down", ns, u.failures)
+	u.down = true
+	u.backoff = h.minBackoff
+	u.gauge.Update(0)
+	h.updateUnhealthy()
+	go h.probeUntilUp(ns)
+}
+
+// updateUnhealthy publishes the number of nameservers that are down.
+// Must be called under the lock.
+func (h *healthTracker) updateUnhealthy() {
+	var n int64
+	for _, u := range h.upstreams {
+		if u.down {
+			n++
+		}
+	}
+	StatsUnhealthyUpstreams.Update(n)
+}
+
+// probeUntilUp probes ns with exponential backoff until it answers.
+func (h *healthTracker) probeUntilUp(ns string) {
+	for {
+		h.Lock()
+		backoff := h.get(ns).backoff
+		h.Unlock()
+		time.Sleep(backoff)
+
+		StatsUpstreamProbeCount.Inc(1)
+		err := h.probe(ns)
+
+		h.Lock()
+		u := h.get(ns)
+		if err == nil {
+			log.Printf("Nameserver %s is answering again", ns)
+			u.failures = 0
+			u.down = false
+			u.gauge.Update(1)
+			h.updateUnhealthy()
+			h.Unlock()
+			return
+		}
+		log.Printf("D! Probe of nameserver %s failed: %v", ns, err)
+		u.backoff *= 2
+		if u.backoff > maxProbeInterval {
+			u.backoff = maxProbeInterval
+		}
+		h.Unlock()
+	}
+}
+
+// probeUpstream sends a query for the root NS records to ns.
+func (s *Server) probeUpstream(ns string) error {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	ctx, cancel := context.WithTimeout(context.Background(), s.dnsUDPClient.ReadTimeout)
+	defer cancel()
+	_, err := s.exchange(ctx, m, ns, false)
+	return err
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startUDPServer serves h on a UDP socket bound to addr.
+func startUDPServer(t *testing.T, addr string, h dns.Handler) string {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: h}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// unusedUDPAddr returns a local address on which nothing listens.
+func unusedUDPAddr(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	dead := unusedUDPAddr(t)
+	live := startUDPServer(t, "127.0.0.1:0", answerA("10.0.0.3"))
+
+	s := New(nil, &Config{Nameservers: []string{dead, live}, ReadTimeout: 100 * time.Millisecond}, "", nil)
+	s.health.minBackoff = 10 * time.Millisecond
+
+	for i := 0; i < maxUpstreamFailures; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if assert.NoError(t, err) {
+			assert.Len(t, r.Answer, 1)
+		}
+	}
+	assert.Equal(t, []string{live}, s.health.available(s.config.Nameservers))
+
+	// Once the nameserver answers again, the probe brings it back.
+	startUDPServer(t, dead, answerA("10.0.0.4"))
+	assert.Eventually(t, func() bool {
+		return len(s.health.available(s.config.Nameservers)) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	r, err := s.forwardQuery(context.Background(), req, false)
+	if assert.NoError(t, err) && assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, "10.0.0.4", r.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestUpstreamHealthMismatch(t *testing.T) {
+	// The nameserver does not echo the random case of the query name.
+	ns := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		req.Question[0].Name = strings.ToLower(req.Question[0].Name)
+		answerA("10.0.0.5")(w, req)
+	}))
+	s := New(nil, &Config{Nameservers: []string{ns}, ReadTimeout: 100 * time.Millisecond, RandomizeCase: true}, "", nil)
+
+	for i := 0; i < maxUpstreamFailures; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("mismatched-case.example.com.", dns.TypeA)
+		_, err := s.forwardQuery(context.Background(), req, false)
+		assert.ErrorIs(t, err, errCaseMismatch)
+	}
+	s.health.Lock()
+	assert.Zero(t, s.health.get(ns).failures)
+	s.health.Unlock()
+}
@@ -33,6 +33,21 @@ func (s *Server) AddressRecords(q dns.Question, name string) (records []dns.RR,
 			records = append(records, r)
 		}
 	}
+
+	// Without IPv6 addresses, map the IPv4 addresses with DNS64.
+	if len(records) == 0 && q.Qtype == dns.TypeAAAA && s.dns64 != nil {
+		for _, ip := range results {
+			if ip4 := ip.To4(); ip4 != nil && !s.dns64.excluded(ip4) {
+				r := new(dns.AAAA)
+				r.Hdr = dns.RR_Header{
+					Name: q.Name, Rrtype: dns.TypeAAAA,
+					Class: dns.ClassINET, Ttl: s.config.HostsTtl,
+				}
+				r.AAAA = s.dns64.embed(ip4)
+				records = append(records, r)
+			}
+		}
+	}
 	return records, nil
 }
 
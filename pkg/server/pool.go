@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamIdleTimeout is how long a pooled connection is kept open without queries.
+const upstreamIdleTimeout = 10 * time.Second
+
+// maxConnTimeouts is the number of queries in a row that may time out on a
+// pooled connection without any response before it is given up on.
+const maxConnTimeouts = 3
+
+var errConnClosed = errors.New("connection to nameserver closed")
+
+// errTimeout is returned when a pooled query is not answered in time.
+var errTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// connPool keeps one long-lived TCP or TLS connection per nameserver and
+// pipelines queries over it (RFC 7766). Queries get a connection-unique
+// message ID, so responses can be matched in any order. It is shared by all
+// forwarding paths of a Server.
+type connPool struct {
+	conns       map[string]*pipeConn
+	idleTimeout time.Duration
+	timeout     time.Duration // for writing a query and waiting for its response
+	sync.Mutex
+}
+
+func newConnPool(timeout time.Duration) *connPool {
+	return &connPool{
+		conns:       make(map[string]*pipeConn),
+		idleTimeout: upstreamIdleTimeout,
+		timeout:     timeout,
+	}
+}
+
+// pipeConn is a connection with queries in flight.
+type pipeConn struct {
+	co      *dns.Conn
+	key     string
+	pool    *connPool
+	pending map[uint16]chan *dns.Msg // by message ID used on the wire
+	idle    *time.Timer              // closes the connection when it fired without queries
+	closed  bool
+	read    time.Time  // when the last response arrived
+	silent  int        // queries timed out in a row with no response since they were sent
+	wmu     sync.Mutex // serializes writes
+	sync.Mutex
+}
+
+// exchange sends req over the pooled connection for key, dialing one with
+// dial if there is none. A query that fails on a reused connection is tried
+// once more on a new one within the same timeout, as the nameserver may have
+// closed the old one. A connection that stopped answering, which may have
+// been dropped without being closed, is closed once a query timed out on it,
+// so that the next query dials a new one.
+func (p *connPool) exchange(ctx context.Context, req *dns.Msg, key string, dial func() (*dns.Conn, error)) (*dns.Msg, error) {
+	deadline := time.Now().Add(p.timeout)
+	c, reused, err := p.get(key, dial)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.exchange(ctx, req, p.timeout)
+	if err == nil || ctx.Err() != nil {
+		return r, err
+	}
+	if isTimeout(err) {
+		if c.unresponsive(reused) {
+			log.Printf("D! Closing connection to nameserver %s: %v", c.co.RemoteAddr(), err)
+			c.close()
+		}
+		return nil, err
+	}
+	if reused {
+		log.Printf("D! Closing connection to nameserver %s: %v", c.co.RemoteAddr(), err)
+		c.close()
+		if c, _, err = p.get(key, dial); err != nil {
+			return nil, err
+		}
+		r, err = c.exchange(ctx, req, time.Until(deadline))
+	}
+	return r, err
+}
+
+// get returns the connection for key, dialing a new one if necessary.
+func (p *connPool) get(key string, dial func() (*dns.Conn, error)) (*pipeConn, bool, error) {
+	p.Lock()
+	if c, ok := p.conns[key]; ok {
+		p.Unlock()
+		StatsUpstreamConnReuseCount.Inc(1)
+		return c, true, nil
+	}
+	p.Unlock()
+
+	co, err := dial()
+	if err != nil {
+		return nil, false, err
+	}
+	StatsUpstreamConnDialCount.Inc(1)
+	c := &pipeConn{co: co, key: key, pool: p, pending: make(map[uint16]chan *dns.Msg)}
+	c.idle = time.AfterFunc(p.idleTimeout, c.closeIfIdle)
+
+	p.Lock()
+	if existing, ok := p.conns[key]; ok {
+		// Somebody else dialed at the same time, use theirs.
+		p.Unlock()
+		co.Close()
+		c.idle.Stop()
+		StatsUpstreamConnReuseCount.Inc(1)
+		return existing, true, nil
+	}
+	p.conns[key] = c
+	p.Unlock()
+
+	go c.readLoop()
+	return c, false, nil
+}
+
+// remove drops c from the pool, if it is still the connection for its key.
+func (p *connPool) remove(c *pipeConn) {
+	p.Lock()
+	if p.conns[c.key] == c {
+		delete(p.conns, c.key)
+	}
+	p.Unlock()
+}
+
+// exchange sends req and waits for the response with the same ID, for at
+// most timeout or until ctx is done.
+func (c *pipeConn) exchange(ctx context.Context, req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	ch := make(chan *dns.Msg, 1)
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil, errConnClosed
+	}
+	id := dns.Id()
+	for _, taken := c.pending[id]; taken; _, taken = c.pending[id] {
+		id = dns.Id()
+	}
+	c.pending[id] = ch
+	c.idle.Stop()
+	c.Unlock()
+
+	// A shallow copy is enough to send the query with our own ID.
+	q := *req
+	q.Id = id
+
+	sent := time.Now()
+	c.wmu.Lock()
+	c.co.SetWriteDeadline(deadline)
+	err := c.co.WriteMsg(&q)
+	c.wmu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		r.Id = req.Id
+		return r, nil
+	case <-timer.C:
+		err = fmt.Errorf("read %s: %w", c.co.RemoteAddr(), errTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.Lock()
+	delete(c.pending, id)
+	if isTimeout(err) && ctx.Err() == nil && c.read.Before(sent) {
+		c.silent++
+	}
+	c.resetIdle()
+	c.Unlock()
+	return nil, err
+}
+
+// readLoop hands the responses read from the connection to their queries.
+func (c *pipeConn) readLoop() {
+	for {
+		r, err := c.co.ReadMsg()
+		if err != nil {
+			if r == nil {
+				c.close()
+				return
+			}
+			// A malformed but framed message is dropped, its query times
+			// out. The connection is still alive.
+			log.Printf("D! Bad message from nameserver %s: %v", c.co.RemoteAddr(), err)
+		}
+		c.Lock()
+		c.read, c.silent = time.Now(), 0
+		if ch, ok := c.pending[r.Id]; ok && err == nil {
+			delete(c.pending, r.Id)
+			ch <- r
+			c.resetIdle()
+		}
+		c.Unlock()
+	}
+}
+
+// unresponsive reports whether c got no response since the last queries
+// timed out: maxConnTimeouts of them, or any if the connection was reused.
+func (c *pipeConn) unresponsive(reused bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.silent >= maxConnTimeouts || reused && c.silent > 0
+}
+
+// resetIdle starts the idle timer once no queries are in flight.
+// Must be called under the lock.
+func (c *pipeConn) resetIdle() {
+	if len(c.pending) == 0 && !c.closed {
+		c.idle.Reset(c.pool.idleTimeout)
+	}
+}
+
+func (c *pipeConn) closeIfIdle() {
+	c.Lock()
+	idle := len(c.pending) == 0
+	c.Unlock()
+	if idle {
+		c.close()
+	}
+}
+
+// close closes the connection and fails the queries still waiting on it.
+func (c *pipeConn) close() {
+	c.pool.remove(c)
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.idle.Stop()
+	c.co.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTCPServer serves h on a TCP socket and counts the accepted connections.
+func startTCPServer(t *testing.T, h dns.Handler) (string, *countingListener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	srv := &dns.Server{Listener: cl, Handler: h}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return l.Addr().String(), cl
+}
+
+func TestConnPoolPipelining(t *testing.T) {
+	// Queries for slow.example.com. are answered after the others.
+	addr, cl := startTCPServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if strings.HasPrefix(req.Question[0].Name, "slow.") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		answerA("10.0.0.10")(w, req)
+	}))
+	s := New(nil, &Config{Nameservers: []string{addr}, ReadTimeout: time.Second}, "", nil)
+
+	// Warm up the pool, so that the concurrent queries share one connection.
+	warmup := new(dns.Msg)
+	warmup.SetQuestion("example.com.", dns.TypeA)
+	_, err := s.forwardQuery(context.Background(), warmup, true)
+	assert.NoError(t, err)
+
+	names := []string{"slow.example.com.", "a.example.com.", "b.example.com.", "c.example.com."}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			req.Id = 42 // the same ID for all of them
+			r, err := s.forwardQuery(context.Background(), req, true)
+			if assert.NoError(t, err, name) {
+				assert.Equal(t, uint16(42), r.Id, name)
+				assert.Equal(t, name, r.Question[0].Name, name)
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cl.accepted))
+}
+
+func TestConnPoolIdleTimeout(t *testing.T) {
+	addr, cl := startTCPServer(t, answerA("10.0.0.11"))
+	s := New(nil, &Config{Nameservers: []string{addr}, ReadTimeout: time.Second}, "", nil)
+	s.pool.idleTimeout = 50 * time.Millisecond
+
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, err := s.forwardQuery(context.Background(), req, true)
+		assert.NoError(t, err)
+	}
+
+	query()
+	assert.Eventually(t, func() bool {
+		s.pool.Lock()
+		defer s.pool.Unlock()
+		return len(s.pool.conns) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	query()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cl.accepted))
+}
+
+func TestConnPoolUnresponsive(t *testing.T) {
+	// The nameserver never answers over the first connection.
+	var mu sync.Mutex
+	var first string
+	addr, cl := startTCPServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		if first == "" {
+			first = w.RemoteAddr().String()
+		}
+		drop := first == w.RemoteAddr().String()
+		mu.Unlock()
+		if !drop {
+			answerA("10.0.0.12")(w, req)
+		}
+	}))
+	p := newConnPool(100 * time.Millisecond)
+	dial := func() (*dns.Conn, error) { return dns.DialTimeout("tcp", addr, time.Second) }
+	query := func() (*dns.Msg, error) {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		return p.exchange(context.Background(), req, addr, dial)
+	}
+
+	// A single timeout on a new connection may be a slow answer.
+	_, err := query()
+	assert.True(t, isTimeout(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cl.accepted))
+
+	// Another one once it is reused gives up on it, without waiting for a
+	// new one.
+	start := time.Now()
+	_, err = query()
+	assert.True(t, isTimeout(err))
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cl.accepted))
+
+	// The next query dials a new connection.
+	r, err := query()
+	if assert.NoError(t, err) {
+		assert.Len(t, r.Answer, 1)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cl.accepted))
+}
+
+func TestConnPoolMalformed(t *testing.T) {
+	// The response ends in the middle of an A record.
+	addr, cl := startTCPServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		b, _ := m.Pack()
+		b[7] = 1
+		w.Write(append(b, 0, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10))
+	}))
+	p := newConnPool(100 * time.Millisecond)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	r, err := p.exchange(context.Background(), req, addr, func() (*dns.Conn, error) {
+		return dns.DialTimeout("tcp", addr, time.Second)
+	})
+	assert.Nil(t, r)
+	assert.True(t, isTimeout(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cl.accepted))
+}
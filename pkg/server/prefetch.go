@@ -0,0 +1,49 @@
+package server
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/soulteary/go-dnsmasq/pkg/cache"
+)
+
+// prefetch resolves req again in the background if its answer cached under
+// key is popular and about to expire, so that the next client does not miss
+// it. At most PrefetchConcurrency prefetches run at a time, others are skipped.
+func (s *Server) prefetch(w dns.ResponseWriter, req *dns.Msg, key string) {
+	if s.prefetchSem == nil {
+		return
+	}
+	select {
+	case s.prefetchSem <- struct{}{}:
+	default:
+		return
+	}
+	if !s.rcache.Due(key) {
+		<-s.prefetchSem
+		return
+	}
+	log.Printf("D! [%d] Prefetching cached response for '%s'", req.Id, req.Question[0].Name)
+	StatsPrefetchCount.Inc(1)
+
+	rw := &refreshWriter{local: w.LocalAddr(), remote: w.RemoteAddr()}
+	req = req.Copy()
+	go func() {
+		defer func() { <-s.prefetchSem }()
+		tcp, dnssec, _, m, err := s.serveDNS(rw, req)
+		if err != nil || m.Rcode == dns.RcodeServerFailure && !isBogus(m) || m.Truncated {
+			log.Printf("D! [%d] Failed to prefetch response for '%s'", req.Id, req.Question[0].Name)
+			s.rcache.PrefetchFailed(key)
+			return
+		}
+		// An answer for another client subnet scope does not replace the
+		// cached one, which is left to expire.
+		q := req.Question[0]
+		if subnet := s.clientSubnet(rw, req); subnet != nil &&
+			ecsCacheKey(cache.Key(q, dnssec, tcp), subnet, ecsScope(m)) != key {
+			s.cacheInsert(q, dnssec, tcp, m, subnet)
+			return
+		}
+		s.rcache.RefreshMessage(key, m)
+	}()
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/soulteary/go-dnsmasq/pkg/cache"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetch(t *testing.T) {
+	// Each answer of the nameserver has the next address.
+	var queries int32
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		n := atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+			A:   net.IPv4(192, 0, 2, byte(n)),
+		}}
+		w.WriteMsg(m)
+	}))
+
+	hits := make(chanCounter, 1)
+	defer func(c cache.Counter) { cache.StatsPrefetchHitCount = c }(cache.StatsPrefetchHitCount)
+	cache.StatsPrefetchHitCount = hits
+
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{
+		Nameservers:         []string{upstream},
+		RCache:              10,
+		RCacheTtl:           time.Minute,
+		Prefetch:            true,
+		PrefetchHits:        2,
+		PrefetchPercent:     50,
+		PrefetchConcurrency: 1,
+		ReadTimeout:         time.Second,
+	}, "", nil)
+	query := func() string {
+		req := new(dns.Msg)
+		req.SetQuestion("popular.test.", dns.TypeA)
+		w := NewWriter("udp", "127.0.0.1:0")
+		s.ServeDNS(w, req)
+		if m := w.Msg(); assert.NotNil(t, m) && assert.Len(t, m.Answer, 1) {
+			return m.Answer[0].(*dns.A).A.String()
+		}
+		return ""
+	}
+
+	assert.Equal(t, "192.0.2.1", query())
+	assert.Equal(t, "192.0.2.1", query())
+	time.Sleep(600 * time.Millisecond)
+	// The second hit after half of the TTL refreshes the answer.
+	assert.Equal(t, "192.0.2.1", query())
+	for i := 0; i < 20 && atomic.LoadInt32(&queries) < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	// After the first answer expired, the prefetched one is still cached.
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, "192.0.2.2", query())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+	select {
+	case <-hits:
+	default:
+		t.Error("the prefetch that prevented a miss was not counted")
+	}
+}
+
+func TestPrefetchFailed(t *testing.T) {
+	// The nameserver fails the second query, the first prefetch.
+	var queries int32
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if atomic.AddInt32(&queries, 1) == 2 {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+				A:   net.IPv4(192, 0, 2, 1),
+			}}
+		}
+		w.WriteMsg(m)
+	}))
+
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{
+		Nameservers:         []string{upstream},
+		RCache:              10,
+		RCacheTtl:           time.Minute,
+		Prefetch:            true,
+		PrefetchHits:        1,
+		PrefetchPercent:     10,
+		PrefetchConcurrency: 1,
+		ReadTimeout:         time.Second,
+		Attempts:            1,
+	}, "", nil)
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion("popular.test.", dns.TypeA)
+		s.ServeDNS(NewWriter("udp", "127.0.0.1:0"), req)
+	}
+	wait := func(n int32) {
+		for i := 0; i < 20 && atomic.LoadInt32(&queries) < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, n, atomic.LoadInt32(&queries))
+	}
+
+	query()
+	time.Sleep(200 * time.Millisecond)
+	query()
+	wait(2)
+
+	// The next hit prefetches the answer again.
+	time.Sleep(50 * time.Millisecond)
+	query()
+	wait(3)
+}
+
+func TestPrefetchECSScope(t *testing.T) {
+	// The first answer has a scope of /16, the prefetched one of /24.
+	var queries int32
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		n := atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+			A:   net.IPv4(192, 0, 2, byte(n)),
+		}}
+		m.SetEdns0(4096, false)
+		e := *findSubnet(req.IsEdns0())
+		e.SourceScope = 16
+		if n > 1 {
+			e.SourceScope = 24
+		}
+		o := m.IsEdns0()
+		o.Option = append(o.Option, &e)
+		w.WriteMsg(m)
+	}))
+
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{
+		Nameservers:         []string{upstream},
+		RCache:              10,
+		RCacheTtl:           time.Minute,
+		Prefetch:            true,
+		PrefetchHits:        2,
+		PrefetchPercent:     50,
+		PrefetchConcurrency: 1,
+		ReadTimeout:         time.Second,
+		ECSMode:             ECSPass,
+	}, "", nil)
+	q := dns.Question{Name: "popular.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion(q.Name, q.Qtype)
+		req.SetEdns0(4096, false)
+		req.IsEdns0().Option = []dns.EDNS0{clientSubnet("203.0.113.0")}
+		s.ServeDNS(NewWriter("udp", "192.0.2.1:1234"), req)
+	}
+	cached := func(addr string) (string, string) {
+		m, key := s.cacheHitKey(q, false, false, 1, clientSubnet(addr))
+		if m == nil || len(m.Answer) == 0 {
+			return "", key
+		}
+		return m.Answer[0].(*dns.A).A.String(), key
+	}
+
+	query()
+	query()
+	_, wide := cached("203.0.113.0")
+	time.Sleep(600 * time.Millisecond)
+	query()
+	for i := 0; i < 20; i++ {
+		if _, key := cached("203.0.113.0"); key != wide {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The prefetched answer is cached for the /24 only, the rest of the /16
+	// keeps the answer it had.
+	a, key := cached("203.0.113.0")
+	assert.Equal(t, "192.0.2.2", a)
+	assert.NotEqual(t, wide, key)
+	a, key = cached("203.0.200.0")
+	assert.Equal(t, "192.0.2.1", a)
+	assert.Equal(t, wide, key)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// stopRebind turns an answer that resolves a name outside the allowed
+// domains to a private address into NXDOMAIN, so that a public name cannot
+// be used to reach hosts on the local network (DNS rebinding).
+func (s *Server) stopRebind(req, r *dns.Msg) *dns.Msg {
+	if _, _, ok := s.rebindAllow.lookup(req.Question[0].Name); ok {
+		return r
+	}
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if isPrivateIP(ip) {
+			log.Printf("D! [%d] Blocking answer for '%s', %s resolves to private address %s",
+				req.Id, req.Question[0].Name, rr.Header().Name, ip)
+			StatsRebindBlockedCount.Inc(1)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			return m
+		}
+	}
+	return r
+}
+
+// isPrivateIP reports whether ip is unspecified or in one of privateNets.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
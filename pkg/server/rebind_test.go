@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopDNSRebind(t *testing.T) {
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		switch req.Question[0].Name {
+		case "public.example.com.":
+			answerA("93.184.216.34")(w, req)
+		case "v6.example.com.":
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = []dns.RR{&dns.AAAA{
+				Hdr:  dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: net.ParseIP("fe80::1"),
+			}}
+			w.WriteMsg(m)
+		default:
+			answerA("192.168.1.10")(w, req)
+		}
+	}))
+	s := New(nil, &Config{
+		Nameservers:     []string{upstream},
+		StopDNSRebind:   true,
+		RebindDomainsOK: []string{"corp.example.com"},
+		Stub:            map[string][]string{"lan.": {upstream}, "public.lan.": {StubDefault}},
+		ReadTimeout:     time.Second,
+	}, "", nil)
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantRcode int
+	}{
+		{name: "public.example.com.", qtype: dns.TypeA},
+		{name: "evil.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "v6.example.com.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeNameError},
+		{name: "corp.example.com.", qtype: dns.TypeA},
+		{name: "printer.CORP.example.com.", qtype: dns.TypeA},
+		{name: "nas.lan.", qtype: dns.TypeA},
+		{name: "www.public.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.wantRcode, r.Rcode, tc.name)
+		}
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for _, ip := range []string{"0.1.2.3", "10.1.2.3", "172.31.255.255", "192.168.0.1", "127.0.0.1", "169.254.1.1", "0.0.0.0", "::", "::1", "fd12::1", "fe80::1", "::ffff:192.168.0.1"} {
+		assert.True(t, isPrivateIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "172.32.0.1", "2001:db8::1"} {
+		assert.False(t, isPrivateIP(net.ParseIP(ip)), ip)
+	}
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultRootHints are the IPv4 addresses of the root servers a-m.root-servers.net.
+var DefaultRootHints = []string{
+	"198.41.0.4:53",
+	"170.247.170.2:53",
+	"192.33.4.12:53",
+	"199.7.91.13:53",
+	"192.203.230.10:53",
+	"192.5.5.241:53",
+	"192.112.36.4:53",
+	"198.97.190.53:53",
+	"192.36.148.17:53",
+	"192.58.128.30:53",
+	"193.0.14.129:53",
+	"199.7.83.42:53",
+	"202.12.27.33:53",
+}
+
+const (
+	maxReferrals      = 20 // referrals followed to resolve one name
+	maxCNAMEs         = 8  // length of a CNAME chain that is followed
+	maxRecursionDepth = 4  // nesting of lookups of nameservers without glue
+	maxDelegations    = 10000
+	maxDelegationTTL  = 24 * time.Hour
+)
+
+var (
+	errTooManyReferrals = errors.New("too many referrals")
+	errCNAMELoop        = errors.New("CNAME chain too long or looping")
+	errNoNameservers    = errors.New("no nameserver answered")
+	errLameNameserver   = errors.New("nameserver is not authoritative")
+)
+
+// delegation is a cached referral to the nameservers of a zone.
+type delegation struct {
+	servers []string // ip:port of the nameservers, taken from glue or resolved
+	expires time.Time
+}
+
+// recursor resolves names iteratively, starting at the root servers, and
+// caches the delegations it learns on the way.
+type recursor struct {
+	roots []string
+	port  string // port of the nameservers learned from referrals
+	sync.Mutex
+	zones map[string]delegation
+}
+
+func newRecursor(roots []string) *recursor {
+	return &recursor{roots: roots, port: "53", zones: make(map[string]delegation)}
+}
+
+// closest returns the closest enclosing zone of name with known nameservers.
+func (r *recursor) closest(name string) (string, []string) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		if d, ok := r.zones[zone]; ok {
+			if now.Before(d.expires) {
+				return zone, d.servers
+			}
+			delete(r.zones, zone)
+		}
+	}
+	return ".", r.roots
+}
+
+// store caches the nameservers of zone for ttl seconds.
+func (r *recursor) store(zone string, servers []string, ttl uint32) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	if len(r.zones) >= maxDelegations {
+		for z, d := range r.zones {
+			if !now.Before(d.expires) {
+				delete(r.zones, z)
+			}
+		}
+		if len(r.zones) >= maxDelegations {
+			r.zones = make(map[string]delegation)
+		}
+	}
+	expiry := time.Duration(ttl) * time.Second
+	if expiry > maxDelegationTTL {
+		expiry = maxDelegationTTL
+	}
+	r.zones[strings.ToLower(zone)] = delegation{servers: servers, expires: now.Add(expiry)}
+}
+
+// recurse resolves req iteratively and follows CNAME chains across zones.
+func (s *Server) recurse(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	do := false
+	if o := req.IsEdns0(); o != nil {
+		do = o.Do()
+	}
+
+	var chain []dns.RR
+	seen := map[string]bool{strings.ToLower(q.Name): true}
+	for {
+		r, err := s.iterate(ctx, q, do, 0)
+		if err != nil {
+			return nil, err
+		}
+		target := cnameTarget(r.Answer, q)
+		if target == "" || r.Rcode != dns.RcodeSuccess {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.RecursionAvailable = true
+			m.Rcode = r.Rcode
+			m.Answer = append(chain, r.Answer...)
+			m.Ns = r.Ns
+			if o := r.IsEdns0(); o != nil {
+				m.Extra = []dns.RR{o}
+			}
+			return m, nil
+		}
+		chain = append(chain, r.Answer...)
+		if len(seen) > maxCNAMEs || seen[strings.ToLower(target)] {
+			return nil, errCNAMELoop
+		}
+		seen[strings.ToLower(target)] = true
+		log.Printf("D! [%d] Following CNAME of '%s' to '%s'", req.Id, q.Name, target)
+		q.Name = target
+	}
+}
+
+// iterate resolves q by following referrals from the closest zone with
+// known nameservers. The answer may end in a CNAME that points elsewhere.
+func (s *Server) iterate(ctx context.Context, q dns.Question, do bool, depth int) (*dns.Msg, error) {
+	zone, servers := s.recursor.closest(q.Name)
+	for i := 0; i < maxReferrals; i++ {
+		r, err := s.queryAuthoritative(ctx, q, do, zone, servers)
+		if err != nil {
+			return nil, fmt.Errorf("querying nameservers of %s: %w", zone, err)
+		}
+		child, names, ttl := referral(r, zone, q.Name)
+		if child == "" {
+			r.Answer = answerChain(r.Answer, q, zone)
+			return r, nil
+		}
+		addrs := s.glue(ctx, zone, r.Extra, names, depth)
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no address of a nameserver of %s", child)
+		}
+		log.Printf("D! Referral for '%s' from %s to %s", q.Name, zone, child)
+		s.recursor.store(child, addrs, ttl)
+		zone, servers = child, addrs
+	}
+	return nil, errTooManyReferrals
+}
+
+// queryAuthoritative sends q to each of servers, the nameservers of zone, in
+// turn until one of them gives a usable answer: an authoritative one or a
+// referral further down. Lame servers, which refer back up or answer
+// without authority, are skipped.
+func (s *Server) queryAuthoritative(ctx context.Context, q dns.Question, do bool, zone string, servers []string) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	req.RecursionDesired = false
+	req.SetEdns0(4096, do)
+
+	err := errNoNameservers
+	for _, ns := range servers {
+		if ctx.Err() != nil {
+			return nil, errQueryDeadline
+		}
+		var r *dns.Msg
+		r, err = s.exchange(ctx, req, ns, false)
+		if err != nil {
+			log.Printf("D! Failed to query %s for '%s': %v", ns, q.Name, err)
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			log.Printf("D! Nameserver %s answered '%s' with %s", ns, q.Name, dns.RcodeToString[r.Rcode])
+			err = errNoNameservers
+			continue
+		}
+		if child, _, _ := referral(r, zone, q.Name); child == "" && !authoritative(r, zone, q.Name) {
+			log.Printf("D! Nameserver %s of %s is lame for '%s'", ns, zone, q.Name)
+			err = errLameNameserver
+			continue
+		}
+		return r, nil
+	}
+	return nil, err
+}
+
+// glue returns the addresses of the nameservers names, taken from the
+// additional section of a referral by the nameservers of zone or else
+// resolved from the root. Only glue for names in zone is accepted, the
+// nameservers of zone have no say about the addresses of other names.
+func (s *Server) glue(ctx context.Context, zone string, extra []dns.RR, names []string, depth int) []string {
+	var v4, v6 []string
+	for _, rr := range extra {
+		for _, name := range names {
+			if !strings.EqualFold(rr.Header().Name, name) || !dns.IsSubDomain(zone, name) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				v4 = append(v4, net.JoinHostPort(rr.A.String(), s.recursor.port))
+			case *dns.AAAA:
+				v6 = append(v6, net.JoinHostPort(rr.AAAA.String(), s.recursor.port))
+			}
+		}
+	}
+	if len(v4)+len(v6) > 0 || depth >= maxRecursionDepth {
+		return append(v4, v6...)
+	}
+
+	for _, name := range names {
+		r, err := s.iterate(ctx, dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, depth+1)
+		if err != nil {
+			log.Printf("D! Failed to resolve nameserver '%s': %v", name, err)
+			continue
+		}
+		for _, rr := range r.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				v4 = append(v4, net.JoinHostPort(a.A.String(), s.recursor.port))
+			}
+		}
+		if len(v4) > 0 {
+			break
+		}
+	}
+	return v4
+}
+
+// referral returns the zone below zone that r delegates qname to, together
+// with the names of its nameservers and their TTL. child is empty if r is
+// not a referral.
+func referral(r *dns.Msg, zone, qname string) (child string, names []string, ttl uint32) {
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 {
+		return "", nil, 0
+	}
+	for _, rr := range r.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == strings.ToLower(zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, strings.ToLower(qname)) {
+			continue
+		}
+		if child == "" {
+			child, ttl = owner, ns.Hdr.Ttl
+		}
+		if owner != child {
+			continue
+		}
+		names = append(names, ns.Ns)
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+	}
+	return child, names, ttl
+}
+
+// authoritative reports whether r is an answer of a nameserver of zone for
+// qname: one with the AA bit, or a negative answer with the SOA record of
+// zone or of a zone below it that qname is in.
+func authoritative(r *dns.Msg, zone, qname string) bool {
+	if r.Authoritative {
+		return true
+	}
+	if r.Rcode != dns.RcodeNameError && len(r.Answer) > 0 {
+		return false
+	}
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(zone, soa.Hdr.Name) && dns.IsSubDomain(soa.Hdr.Name, qname) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerChain returns the records of answer that are on the CNAME chain of
+// q, as far as it stays in zone. The nameservers of zone have no say about
+// the records of other names, the chain is followed elsewhere from there.
+func answerChain(answer []dns.RR, q dns.Question, zone string) []dns.RR {
+	var chain []dns.RR
+	name := q.Name
+	seen := make(map[string]bool)
+	for dns.IsSubDomain(zone, name) && !seen[strings.ToLower(name)] {
+		seen[strings.ToLower(name)] = true
+		next := ""
+		for _, rr := range answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			chain = append(chain, rr)
+			if cname, ok := rr.(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return chain
+}
+
+// cnameTarget follows the CNAME chain of q through answer and returns the
+// name it ends at. It is empty if answer holds the records of q or no CNAME.
+func cnameTarget(answer []dns.RR, q dns.Question) string {
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+		return ""
+	}
+	name := q.Name
+	followed := 0
+	for followed <= len(answer) {
+		next := ""
+		for _, rr := range answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == q.Qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+		followed++
+		if strings.EqualFold(name, q.Name) {
+			break // a loop, which recurse rejects
+		}
+	}
+	if followed == 0 {
+		return ""
+	}
+	return name
+}
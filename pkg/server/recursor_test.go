@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// authServer answers authoritatively from records given in zone file syntax.
+// The zones it serves are the owners of its SOA records, NS records of any
+// other owner are delegations that it refers queries to.
+func authServer(t *testing.T, records ...string) dns.HandlerFunc {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		// Refer queries below a delegation to its nameservers with glue.
+		cut := ""
+		for _, rr := range rrs {
+			owner := rr.Header().Name
+			if rr.Header().Rrtype == dns.TypeNS && dns.IsSubDomain(owner, q.Name) && !isApex(rrs, owner) &&
+				(cut == "" || dns.CountLabel(owner) > dns.CountLabel(cut)) {
+				cut = owner
+			}
+		}
+		if cut != "" {
+			for _, rr := range rrs {
+				if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == cut {
+					m.Ns = append(m.Ns, ns)
+					for _, glue := range rrs {
+						if glue.Header().Name == ns.Ns && glue.Header().Rrtype == dns.TypeA {
+							m.Extra = append(m.Extra, glue)
+						}
+					}
+				}
+			}
+			w.WriteMsg(m)
+			return
+		}
+
+		m.Authoritative = true
+		exists := false
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, q.Name) {
+				continue
+			}
+			exists = true
+			if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if len(m.Answer) == 0 {
+			if !exists {
+				m.Rcode = dns.RcodeNameError
+			}
+			for _, rr := range rrs {
+				if rr.Header().Rrtype == dns.TypeSOA && dns.IsSubDomain(rr.Header().Name, q.Name) {
+					m.Ns = append(m.Ns, rr)
+				}
+			}
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func isApex(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA && rr.Header().Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// countQueries wraps h and counts the queries it gets.
+func countQueries(h dns.HandlerFunc, n *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(n, 1)
+		h(w, req)
+	}
+}
+
+// startHierarchy starts a root, a test. and an example.test. nameserver on
+// 127.0.0.1-3, all on the same port, and returns the port.
+func startHierarchy(t *testing.T, rootQueries *int32) string {
+	root := startUDPServer(t, "127.0.0.1:0", countQueries(authServer(t,
+		". 86400 IN SOA a.root. hostmaster.root. 1 1800 900 604800 86400",
+		"test. 86400 IN NS ns.test.",
+		"ns.test. 86400 IN A 127.0.0.2",
+	), rootQueries))
+	_, port, _ := net.SplitHostPort(root)
+
+	startUDPServer(t, net.JoinHostPort("127.0.0.2", port), authServer(t,
+		"test. 3600 IN SOA ns.test. hostmaster.test. 1 1800 900 604800 60",
+		"example.test. 3600 IN NS ns1.example.test.",
+		"ns1.example.test. 3600 IN A 127.0.0.3",
+		// other.test. has no glue, its nameserver lives in example.test.
+		"other.test. 3600 IN NS ns2.example.test.",
+	))
+	startUDPServer(t, net.JoinHostPort("127.0.0.3", port), authServer(t,
+		"example.test. 3600 IN SOA ns1.example.test. hostmaster.example.test. 1 1800 900 604800 60",
+		"other.test. 3600 IN SOA ns2.example.test. hostmaster.example.test. 1 1800 900 604800 60",
+		"ns1.example.test. 3600 IN A 127.0.0.3",
+		"ns2.example.test. 3600 IN A 127.0.0.3",
+		"www.example.test. 300 IN A 10.0.0.1",
+		"alias.example.test. 300 IN CNAME www.other.test.",
+		"www.other.test. 300 IN A 10.0.0.2",
+		"loop.example.test. 300 IN CNAME loop.example.test.",
+	))
+	return port
+}
+
+func TestRecursiveResolution(t *testing.T) {
+	var rootQueries int32
+	port := startHierarchy(t, &rootQueries)
+	s := New(nil, &Config{Recursive: true, RootHints: []string{net.JoinHostPort("127.0.0.1", port)}, ReadTimeout: time.Second}, "", nil)
+	s.recursor.port = port
+
+	tests := []struct {
+		name      string
+		wantRcode int
+		wantA     string
+		wantChain int
+		wantErr   bool
+	}{
+		{name: "www.example.test.", wantA: "10.0.0.1"},
+		{name: "alias.example.test.", wantA: "10.0.0.2", wantChain: 1},
+		{name: "missing.example.test.", wantRcode: dns.RcodeNameError},
+		{name: "loop.example.test.", wantErr: true},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if tc.wantErr {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		assert.Equal(t, tc.wantRcode, r.Rcode, tc.name)
+		assert.True(t, r.RecursionAvailable, tc.name)
+		if tc.wantA != "" && assert.Len(t, r.Answer, tc.wantChain+1, tc.name) {
+			assert.Equal(t, tc.wantA, r.Answer[tc.wantChain].(*dns.A).A.String(), tc.name)
+		}
+	}
+
+	// The delegations are cached, the root is not asked again.
+	before := atomic.LoadInt32(&rootQueries)
+	req := new(dns.Msg)
+	req.SetQuestion("www.other.test.", dns.TypeA)
+	_, err := s.forwardQuery(context.Background(), req, false)
+	assert.NoError(t, err)
+	assert.Equal(t, before, atomic.LoadInt32(&rootQueries))
+}
+
+func TestLameNameserver(t *testing.T) {
+	// The first nameserver of test. refers back to the root.
+	root := startUDPServer(t, "127.0.0.1:0", authServer(t,
+		". 86400 IN SOA a.root. hostmaster.root. 1 1800 900 604800 86400",
+		"test. 86400 IN NS ns1.test.",
+		"test. 86400 IN NS ns2.test.",
+		"ns1.test. 86400 IN A 127.0.0.4",
+		"ns2.test. 86400 IN A 127.0.0.5",
+	))
+	_, port, _ := net.SplitHostPort(root)
+	startUDPServer(t, net.JoinHostPort("127.0.0.4", port), dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Ns = []dns.RR{mustRR(t, ". 86400 IN NS a.root.")}
+		w.WriteMsg(m)
+	}))
+	startUDPServer(t, net.JoinHostPort("127.0.0.5", port), authServer(t,
+		"test. 3600 IN SOA ns2.test. hostmaster.test. 1 1800 900 604800 60",
+		"www.test. 300 IN A 10.0.0.9",
+	))
+	s := New(nil, &Config{Recursive: true, RootHints: []string{root}, ReadTimeout: time.Second}, "", nil)
+	s.recursor.port = port
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.test.", dns.TypeA)
+	r, err := s.forwardQuery(context.Background(), req, false)
+	if assert.NoError(t, err) && assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, "10.0.0.9", r.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestAuthoritative(t *testing.T) {
+	soa := mustRR(t, "example.test. 60 IN SOA ns1.example.test. hostmaster.example.test. 1 1800 900 604800 60")
+	m := new(dns.Msg)
+	m.Ns = []dns.RR{soa}
+	assert.True(t, authoritative(m, "test.", "www.example.test."))
+	assert.True(t, authoritative(m, "example.test.", "www.example.test."))
+	assert.False(t, authoritative(m, "www.example.test.", "www.example.test."))
+	assert.False(t, authoritative(m, "test.", "www.other.test."))
+
+	m.Ns = nil
+	assert.False(t, authoritative(m, "test.", "www.example.test."))
+	m.Authoritative = true
+	assert.True(t, authoritative(m, "test.", "www.example.test."))
+}
+
+func TestReferral(t *testing.T) {
+	ns := func(owner, target string) dns.RR {
+		rr, _ := dns.NewRR(owner + " 3600 IN NS " + target)
+		return rr
+	}
+	m := new(dns.Msg)
+	m.Ns = []dns.RR{ns("example.test.", "a.example.test."), ns("example.test.", "b.example.test.")}
+
+	child, names, ttl := referral(m, "test.", "www.example.test.")
+	assert.Equal(t, "example.test.", child)
+	assert.Equal(t, []string{"a.example.test.", "b.example.test."}, names)
+	assert.Equal(t, uint32(3600), ttl)
+
+	// An upward or sideways referral is lame.
+	child, _, _ = referral(m, "example.test.", "www.example.test.")
+	assert.Equal(t, "", child)
+	child, _, _ = referral(m, "test.", "www.other.test.")
+	assert.Equal(t, "", child)
+}
+
+func TestAnswerChain(t *testing.T) {
+	answer := []dns.RR{
+		mustRR(t, "www.example.test. 300 IN CNAME web.example.test."),
+		mustRR(t, "web.example.test. 300 IN CNAME cdn.other.test."),
+		mustRR(t, "cdn.other.test. 300 IN A 10.0.0.66"),
+		mustRR(t, "web.example.test. 300 IN RRSIG CNAME 8 3 300 20300101000000 20200101000000 1 example.test. AAAA"),
+		mustRR(t, "bank.example.test. 300 IN A 10.0.0.67"),
+	}
+	q := dns.Question{Name: "WWW.example.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// Records off the chain or out of the zone are dropped.
+	assert.Equal(t, []dns.RR{answer[0], answer[1], answer[3]}, answerChain(answer, q, "example.test."))
+	assert.Equal(t, []dns.RR{answer[0], answer[1], answer[3], answer[2]}, answerChain(answer, q, "test."))
+	assert.Empty(t, answerChain(answer, q, "other.test."))
+
+	q.Qtype = dns.TypeCNAME
+	assert.Equal(t, answer[:1], answerChain(answer, q, "test."))
+}
+
+func TestGlueInZone(t *testing.T) {
+	s := New(nil, &Config{Recursive: true, ReadTimeout: time.Second}, "", nil)
+	extra := []dns.RR{
+		mustRR(t, "ns1.example.test. 3600 IN A 127.0.0.3"),
+		mustRR(t, "ns.elsewhere. 3600 IN A 127.0.0.66"),
+	}
+
+	// Glue for names outside of the zone is ignored.
+	names := []string{"ns1.example.test.", "ns.elsewhere."}
+	assert.Equal(t, []string{"127.0.0.3:53"}, s.glue(context.Background(), "test.", extra, names, maxRecursionDepth))
+	assert.Empty(t, s.glue(context.Background(), "test.", extra, names[1:], maxRecursionDepth))
+}
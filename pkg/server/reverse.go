@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// privateNets are the address ranges whose reverse lookups are answered
+// locally in bogus-priv mode and that public names may not resolve to with
+// stop-dns-rebind: RFC 1918, "this network", loopback, link-local and unique
+// local IPv6 addresses.
+var privateNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+}
+
+// privateNetworks are the parsed privateNets.
+var privateNetworks = func() []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(privateNets))
+	for _, cidr := range privateNets {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}()
+
+// privateReverse is the trie of the reverse zones of privateNets.
+var privateReverse = func() *stubNode {
+	zones := make(map[string][]string)
+	for _, n := range privateNetworks {
+		for _, zone := range reverseZones(n) {
+			zones[zone] = []string{}
+		}
+	}
+	return newStubTrie(zones)
+}()
+
+// reverseZones returns the in-addr.arpa or ip6.arpa zones covering n.
+// A prefix that does not end on a label boundary, an octet for IPv4 and
+// a nibble for IPv6, is split into the zones of the next longer boundary,
+// e.g. 172.16.0.0/12 into 16.172.in-addr.arpa. through 31.172.in-addr.arpa.
+func reverseZones(n *net.IPNet) []string {
+	ones, bits := n.Mask.Size()
+	ip, step, suffix := n.IP.To4(), 8, "in-addr.arpa."
+	if bits == 8*net.IPv6len {
+		ip, step, suffix = n.IP.To16(), 4, "ip6.arpa."
+	}
+
+	label := func(i int) int {
+		if step == 8 {
+			return int(ip[i])
+		}
+		if i%2 == 0 {
+			return int(ip[i/2] >> 4)
+		}
+		return int(ip[i/2] & 0x0f)
+	}
+	format := func(v int) string {
+		if step == 8 {
+			return strconv.Itoa(v)
+		}
+		return strconv.FormatInt(int64(v), 16)
+	}
+
+	nlabels := (ones + step - 1) / step
+	if nlabels == 0 {
+		return []string{suffix}
+	}
+	var labels []string
+	for i := nlabels - 2; i >= 0; i-- {
+		labels = append(labels, format(label(i)))
+	}
+	parent := strings.Join(append(labels, suffix), ".")
+
+	spread := 1 << (nlabels*step - ones)
+	zones := make([]string, 0, spread)
+	first := label(nlabels - 1)
+	for v := first; v < first+spread; v++ {
+		zones = append(zones, format(v)+"."+parent)
+	}
+	return zones
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseZones(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want []string
+	}{
+		{cidr: "10.0.0.0/8", want: []string{"10.in-addr.arpa."}},
+		{cidr: "192.168.1.0/24", want: []string{"1.168.192.in-addr.arpa."}},
+		{cidr: "192.168.1.7/32", want: []string{"7.1.168.192.in-addr.arpa."}},
+		{cidr: "10.1.2.0/23", want: []string{"2.1.10.in-addr.arpa.", "3.1.10.in-addr.arpa."}},
+		{cidr: "0.0.0.0/0", want: []string{"in-addr.arpa."}},
+		{cidr: "fd00::/8", want: []string{"d.f.ip6.arpa."}},
+		{cidr: "2001:db8::/32", want: []string{"8.b.d.0.1.0.0.2.ip6.arpa."}},
+		{cidr: "fe80::/10", want: []string{"8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.", "a.e.f.ip6.arpa.", "b.e.f.ip6.arpa."}},
+	}
+	for _, tc := range tests {
+		_, n, err := net.ParseCIDR(tc.cidr)
+		if assert.NoError(t, err, tc.cidr) {
+			assert.Equal(t, tc.want, reverseZones(n), tc.cidr)
+		}
+	}
+
+	_, n, _ := net.ParseCIDR("172.16.0.0/12")
+	zones := reverseZones(n)
+	if assert.Len(t, zones, 16) {
+		assert.Equal(t, "16.172.in-addr.arpa.", zones[0])
+		assert.Equal(t, "31.172.in-addr.arpa.", zones[15])
+	}
+}
+
+func TestCreateRevServerMap(t *testing.T) {
+	got, err := CreateRevServerMap([]string{"10.0.0.0/8,10.1.1.1", "192.168.3.4,#", "172.16.0.0/15"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string][]string{
+			"10.in-addr.arpa.":          {"10.1.1.1:53"},
+			"4.3.168.192.in-addr.arpa.": {StubDefault},
+			"16.172.in-addr.arpa.":      {},
+			"17.172.in-addr.arpa.":      {},
+		}, got)
+	}
+
+	for _, rule := range []string{"10.0.0.0/33,10.1.1.1", "example.com,10.1.1.1", "10.0.0.0/8,example.com"} {
+		_, err := CreateRevServerMap([]string{rule})
+		assert.Error(t, err, rule)
+	}
+}
+
+func TestServeDNSReverse(t *testing.T) {
+	def := startUDPServer(t, "127.0.0.1:0", answerPTR("public.example.com."))
+	rev := startUDPServer(t, "127.0.0.1:0", answerPTR("host.corp.lan."))
+	revmap, err := CreateRevServerMap([]string{"10.1.0.0/16," + rev})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{Nameservers: []string{def}, RevServers: revmap, BogusPriv: true, ReadTimeout: time.Second}, "", nil)
+
+	tests := []struct {
+		name      string
+		wantRcode int
+		wantPtr   string
+	}{
+		{name: "7.0.1.10.in-addr.arpa.", wantPtr: "host.corp.lan."},
+		{name: "7.0.2.10.in-addr.arpa.", wantRcode: dns.RcodeNameError},
+		{name: "1.1.16.172.in-addr.arpa.", wantRcode: dns.RcodeNameError},
+		{name: "1.1.32.172.in-addr.arpa.", wantPtr: "public.example.com."},
+		{name: "8.8.8.8.in-addr.arpa.", wantPtr: "public.example.com."},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypePTR)
+		m := s.ServeDNSReverse(NewWriter("udp", "127.0.0.1:0"), req)
+		assert.Equal(t, tc.wantRcode, m.Rcode, tc.name)
+		if tc.wantPtr != "" && assert.Len(t, m.Answer, 1, tc.name) {
+			assert.Equal(t, tc.wantPtr, m.Answer[0].(*dns.PTR).Ptr, tc.name)
+		}
+	}
+}
+
+func answerPTR(ptr string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+			Ptr: ptr,
+		}}
+		w.WriteMsg(m)
+	}
+}
@@ -2,14 +2,18 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-systemd/activation"
 	"github.com/miekg/dns"
 	"github.com/soulteary/go-dnsmasq/pkg/cache"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 type (
@@ -22,7 +26,24 @@ type (
 
 		dnsUDPClient *dns.Client // used for forwarding queries
 		dnsTCPClient *dns.Client // used for forwarding queries
+		dnsTLSClient *dns.Client // used for forwarding queries to DNS-over-TLS nameservers
+		pool         *connPool   // pipelined TCP and TLS connections to nameservers
+		dohClients   dohClients
+		dnscrypt     dnscryptResolvers
+		health       *healthTracker
+		stubs        *stubNode
+		rebindAllow  *stubNode // domains that may resolve to private addresses
+		recursor     *recursor
+		validator    *validator
+		dns64        *dns64             // nil if DNS64 is disabled
+		cookies      *upstreamCookies   // cookies of plain DNS nameservers, nil if disabled
+		cookieSecret []byte             // key of the server cookies given to clients
+		inflight     singleflight.Group // coalesces identical forwarded queries
+		rrIndex      uint32             // rotates the first nameserver with StrategyRoundRobin
 		rcache       *cache.Cache
+		ecsScopes    ecsScopes     // scope prefix lengths of cached answers
+		refreshing   sync.Map      // cache keys of stale answers being refreshed
+		prefetchSem  chan struct{} // limits the prefetches under way, nil if disabled
 		version      string
 	}
 )
@@ -32,25 +53,77 @@ type Hostfile interface {
 	FindReverse(name string) (string, error)
 }
 
-// New returns a new Server.
+// New returns a new Server. config.ReadTimeout is the timeout of a single
+// attempt to query a nameserver, 4s if it is not set, see Config.
 func New(hostfile Hostfile, config *Config, v string, f *PluggableFunc) *Server {
-	return &Server{
+	timeout := config.ReadTimeout
+	if timeout <= 0 {
+		timeout = 4 * time.Second
+	}
+	tlsConfig, err := newTLSConfig(config.TLSCAFile)
+	if err != nil {
+		log.Printf("E! Failed to load TLS CA file, using system roots: %v", err)
+		tlsConfig, _ = newTLSConfig("")
+	}
+
+	cacheOpts := []cache.Option{
+		cache.MinTTL(config.RCacheMinTtl), cache.MaxTTL(config.RCacheMaxTtl),
+		cache.NegativeTTL(config.NegCacheTtl), cache.Stale(config.ServeStale),
+	}
+	if config.Prefetch {
+		cacheOpts = append(cacheOpts, cache.Prefetch(config.PrefetchHits, config.PrefetchPercent))
+	}
+
+	s := &Server{
 		hosts:   hostfile,
 		config:  config,
 		version: v,
-		rcache:  cache.New(config.RCache, config.RCacheTtl),
+		rcache:  cache.New(config.RCache, config.RCacheTtl, cacheOpts...),
 		dnsUDPClient: &dns.Client{
 			Net:          "udp",
-			ReadTimeout:  2 * config.ReadTimeout,
-			WriteTimeout: 2 * config.ReadTimeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
 		},
 		dnsTCPClient: &dns.Client{
 			Net:          "tcp",
-			ReadTimeout:  2 * config.ReadTimeout,
-			WriteTimeout: 2 * config.ReadTimeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		},
+		dnsTLSClient: &dns.Client{
+			Net:          "tcp-tls",
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
 		},
 		pluggableFunc: f,
 	}
+	s.pool = newConnPool(timeout)
+	s.health = newHealthTracker(s.probeUpstream)
+	s.stubs = newStubTrie(config.RevServers, config.Stub)
+	s.rebindAllow = newStubTrie(domainSet(config.RebindDomainsOK))
+	s.recursor = newRecursor(config.RootHints)
+	if config.DNSSEC {
+		anchors, err := loadTrustAnchors(config.TrustAnchorFile)
+		if err != nil {
+			log.Printf("E! Failed to load trust anchors, using the root anchors: %v", err)
+			anchors, _ = loadTrustAnchors("")
+		}
+		s.validator = newValidator(anchors)
+	}
+	if config.DNS64 {
+		if s.dns64, err = newDNS64(config.DNS64Prefix, config.DNS64Exclude); err != nil {
+			log.Printf("E! Failed to set up DNS64, disabling it: %v", err)
+		}
+	}
+	if config.Prefetch {
+		s.prefetchSem = make(chan struct{}, max(config.PrefetchConcurrency, 1))
+	}
+	if config.Cookies {
+		s.cookies = newUpstreamCookies()
+		s.cookieSecret = make([]byte, 32)
+		rand.Read(s.cookieSecret)
+	}
+	return s
 }
 
 // Run is a blocking operation that starts the Server listening on the DNS ports.
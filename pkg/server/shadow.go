@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// shadowQuery is a query mirrored to the shadow nameserver while the
+// nameservers answer it. Its answer is only compared, never used.
+type shadowQuery struct {
+	req  *dns.Msg
+	ns   string
+	done chan struct{}
+	r    *dns.Msg
+	err  error
+}
+
+// mirror sends req to the shadow nameserver if it is among the share of
+// mirrored queries. It returns nil otherwise.
+func (s *Server) mirror(req *dns.Msg, tcp bool) *shadowQuery {
+	ns := s.config.ShadowNameserver
+	if ns == "" {
+		return nil
+	}
+	if p := s.config.ShadowPercent; p > 0 && p < 100 && rand.Intn(100) >= p {
+		return nil
+	}
+	StatsShadowCount.Inc(1)
+
+	// The shadow query outlives the client's one if the nameservers are faster.
+	q := &shadowQuery{req: req.Copy(), ns: ns, done: make(chan struct{})}
+	go func() {
+		defer close(q.done)
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.ReadTimeout)
+		defer cancel()
+		q.r, q.err = s.exchange(ctx, q.req, ns, tcp)
+	}()
+	return q
+}
+
+// compare reports the differences between the answer r of the nameservers
+// and that of the shadow nameserver once it arrived.
+func (q *shadowQuery) compare(r *dns.Msg, err error) {
+	if err != nil || r == nil {
+		// nothing to compare with
+		return
+	}
+	r = r.Copy()
+	go func() {
+		<-q.done
+		name := q.req.Question[0].Name
+		if q.err != nil {
+			log.Printf("E! [%d] Shadow nameserver %s failed for qname '%s': %v", q.req.Id, q.ns, name, q.err)
+			StatsShadowFailureCount.Inc(1)
+			return
+		}
+		if diff := answerDiff(r, q.r); len(diff) > 0 {
+			log.Printf("E! [%d] Shadow nameserver %s answered qname '%s' differently: %s",
+				q.req.Id, q.ns, name, strings.Join(diff, "; "))
+			StatsShadowDiffCount.Inc(1)
+			return
+		}
+		log.Printf("D! [%d] Shadow nameserver %s answered qname '%s' the same", q.req.Id, q.ns, name)
+	}()
+}
+
+// answerDiff describes how the rcode and answer section of shadow differ
+// from those of m. The TTLs, the order of the records and the signatures,
+// which the nameservers return for validation, do not matter.
+func answerDiff(m, shadow *dns.Msg) []string {
+	var diff []string
+	want, got := answerSet(m), answerSet(shadow)
+	for rr := range want {
+		if !got[rr] {
+			diff = append(diff, "missing "+rr)
+		}
+	}
+	for rr := range got {
+		if !want[rr] {
+			diff = append(diff, "extra "+rr)
+		}
+	}
+	sort.Strings(diff)
+	if m.Rcode != shadow.Rcode {
+		rcode := "rcode " + dns.RcodeToString[m.Rcode] + " != " + dns.RcodeToString[shadow.Rcode]
+		diff = append([]string{rcode}, diff...)
+	}
+	return diff
+}
+
+// answerSet returns the records of the answer section of m without TTLs and
+// signatures.
+func answerSet(m *dns.Msg) map[string]bool {
+	set := make(map[string]bool, len(m.Answer))
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		set[rr.String()] = true
+	}
+	return set
+}
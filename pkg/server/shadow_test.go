@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// chanCounter sends the increments to a channel.
+type chanCounter chan int64
+
+func (c chanCounter) Inc(i int64) { c <- i }
+
+func TestAnswerDiff(t *testing.T) {
+	msg := func(rcode int, rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.Rcode = rcode
+		for _, rr := range rrs {
+			m.Answer = append(m.Answer, mustRR(t, rr))
+		}
+		return m
+	}
+	a := msg(dns.RcodeSuccess, "example.com. 300 IN A 192.0.2.1", "example.com. 300 IN A 192.0.2.2")
+
+	assert.Empty(t, answerDiff(a, msg(dns.RcodeSuccess, "EXAMPLE.com. 60 IN A 192.0.2.2", "example.com. 20 IN A 192.0.2.1")))
+	assert.Equal(t, []string{"extra example.com.\t0\tIN\tA\t192.0.2.3", "missing example.com.\t0\tIN\tA\t192.0.2.2"},
+		answerDiff(a, msg(dns.RcodeSuccess, "example.com. 300 IN A 192.0.2.1", "example.com. 300 IN A 192.0.2.3")))
+	assert.Equal(t, []string{"rcode NOERROR != NXDOMAIN", "missing example.com.\t0\tIN\tA\t192.0.2.1", "missing example.com.\t0\tIN\tA\t192.0.2.2"},
+		answerDiff(a, msg(dns.RcodeNameError)))
+}
+
+func TestForwardShadow(t *testing.T) {
+	primary := startUDPServer(t, "127.0.0.1:0", authServer(t,
+		"same.test. 300 IN A 192.0.2.1",
+		"diff.test. 300 IN A 192.0.2.1",
+	))
+	shadow := startUDPServer(t, "127.0.0.1:0", authServer(t,
+		"same.test. 60 IN A 192.0.2.1",
+		"diff.test. 60 IN A 192.0.2.2",
+	))
+
+	diffs, failures := make(chanCounter, 1), make(chanCounter, 1)
+	defer func(d, f Counter) { StatsShadowDiffCount, StatsShadowFailureCount = d, f }(StatsShadowDiffCount, StatsShadowFailureCount)
+	StatsShadowDiffCount, StatsShadowFailureCount = diffs, failures
+
+	s := New(nil, &Config{
+		Nameservers:      []string{primary},
+		ShadowNameserver: shadow,
+		ReadTimeout:      time.Second,
+	}, "", nil)
+	query := func(name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if assert.NoError(t, err, name) && assert.Len(t, r.Answer, 1, name) {
+			// the client always gets the answer of the nameservers
+			assert.Equal(t, "192.0.2.1", r.Answer[0].(*dns.A).A.String(), name)
+		}
+	}
+
+	query("same.test.")
+	query("diff.test.")
+	select {
+	case <-diffs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the different answer of the shadow nameserver was not reported")
+	}
+	assert.Empty(t, diffs)
+	assert.Empty(t, failures)
+}
+
+func TestForwardShadowDNSSEC(t *testing.T) {
+	root := newSignedZone(t, ".")
+	primary := startUDPServer(t, "127.0.0.1:0", &signedUpstream{answers: map[string][]dns.RR{
+		"./DNSKEY":    append(root.dnskey(), root.sig(t, root.dnskey())),
+		"www.test./A": root.sign(t, "www.test. 300 IN A 192.0.2.1"),
+	}})
+	queries := make(chan string, 10)
+	shadow := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries <- dns.TypeToString[req.Question[0].Qtype]
+		authServer(t, "www.test. 60 IN A 192.0.2.1")(w, req)
+	}))
+
+	diffs := make(chanCounter, 1)
+	defer func(d Counter) { StatsShadowDiffCount = d }(StatsShadowDiffCount)
+	StatsShadowDiffCount = diffs
+
+	anchorFile := filepath.Join(t.TempDir(), "anchors")
+	if err := os.WriteFile(anchorFile, []byte(root.ds()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := New(nil, &Config{
+		Nameservers:      []string{primary},
+		ShadowNameserver: shadow,
+		DNSSEC:           true,
+		TrustAnchorFile:  anchorFile,
+		ReadTimeout:      time.Second,
+	}, "", nil)
+	req := new(dns.Msg)
+	req.SetQuestion("www.test.", dns.TypeA)
+	r, err := s.forwardQuery(context.Background(), req, false)
+	if assert.NoError(t, err) {
+		assert.True(t, r.AuthenticatedData)
+	}
+
+	// Only the query of the client is mirrored, not the lookup of the keys
+	// to validate its answer, and the signatures make no difference.
+	assert.Equal(t, "A", <-queries)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, queries)
+	assert.Empty(t, diffs)
+}
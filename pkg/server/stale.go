@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/soulteary/go-dnsmasq/pkg/cache"
+)
+
+// staleTTL is the TTL of the records of stale answers (RFC 8767 section 4).
+const staleTTL = 30
+
+// staleRetry is the time between attempts to refresh a stale answer.
+var staleRetry = 30 * time.Second
+
+// staleAnswerTimeout is how long a client waits for the nameservers before
+// it gets a stale answer, the client response timer of RFC 8767 section 5.
+var staleAnswerTimeout = 1800 * time.Millisecond
+
+// served is the result of serveDNS.
+type served struct {
+	tcp, dnssec bool
+	bufsize     uint16
+	m           *dns.Msg
+	err         error
+}
+
+// serveDNSOrStale is serveDNS, except that a query the nameservers do not
+// answer within staleAnswerTimeout is answered with a stale answer if there
+// is one. The query is refreshed in the background then, joining the
+// forwarded query in flight.
+func (s *Server) serveDNSOrStale(w dns.ResponseWriter, req *dns.Msg) (tcp, dnssec bool, bufsize uint16, m *dns.Msg, stale bool, err error) {
+	if s.config.ServeStale <= 0 {
+		tcp, dnssec, bufsize, m, err = s.serveDNS(w, req)
+		return tcp, dnssec, bufsize, m, false, err
+	}
+	done := make(chan served, 1)
+	go func() {
+		var r served
+		r.tcp, r.dnssec, r.bufsize, r.m, r.err = s.serveDNS(w, req)
+		done <- r
+	}()
+	timer := time.NewTimer(staleAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.tcp, r.dnssec, r.bufsize, r.m, false, r.err
+	case <-timer.C:
+	}
+	tcp, dnssec, bufsize = requestOptions(w, req)
+	if m := s.serveStale(w, req, dnssec, tcp); m != nil {
+		return tcp, dnssec, bufsize, m, true, nil
+	}
+	r := <-done
+	return r.tcp, r.dnssec, r.bufsize, r.m, false, r.err
+}
+
+// cacheStale looks up the cached answer to q for a client in subnet that
+// expired at most ServeStale ago. It returns the answer with its cache key.
+func (s *Server) cacheStale(q dns.Question, dnssec, tcp bool, msgid uint16, subnet *dns.EDNS0_SUBNET) (*dns.Msg, string) {
+	key := cache.Key(q, dnssec, tcp)
+	if subnet == nil {
+		return s.rcache.StaleKey(key, msgid, staleTTL), key
+	}
+	for _, scope := range s.ecsScopes.get(subnet.Family) {
+		scoped := ecsCacheKey(key, subnet, scope)
+		if m := s.rcache.StaleKey(scoped, msgid, staleTTL); m != nil {
+			return m, scoped
+		}
+	}
+	return nil, ""
+}
+
+// serveStale returns a stale answer to req, which the nameservers failed to
+// answer or did not answer in time, or nil if there is none. The answer is
+// refreshed in the background until the nameservers answer again.
+func (s *Server) serveStale(w dns.ResponseWriter, req *dns.Msg, dnssec, tcp bool) *dns.Msg {
+	if s.config.ServeStale <= 0 {
+		return nil
+	}
+	m, key := s.cacheStale(req.Question[0], dnssec, tcp, req.Id, s.clientSubnet(w, req))
+	if m == nil {
+		return nil
+	}
+	log.Printf("D! [%d] Nameservers failed or are slow, answering with a stale cached response", req.Id)
+	StatsStaleCount.Inc(1)
+
+	if _, busy := s.refreshing.LoadOrStore(key, struct{}{}); !busy {
+		go s.refreshStale(key, &refreshWriter{local: w.LocalAddr(), remote: w.RemoteAddr()}, req.Copy(), dnssec, tcp)
+	}
+	return m
+}
+
+// refreshStale resolves req again right away and then every staleRetry
+// until the answer is cached again or it is too old to be served stale.
+func (s *Server) refreshStale(key string, w dns.ResponseWriter, req *dns.Msg, dnssec, tcp bool) {
+	defer s.refreshing.Delete(key)
+	q := req.Question[0]
+	subnet := s.clientSubnet(w, req)
+	for {
+		_, do, _, m, _ := s.serveDNS(w, req)
+		if m.Rcode != dns.RcodeServerFailure || isBogus(m) {
+			log.Printf("D! [%d] Refreshed stale cached response for '%s'", req.Id, q.Name)
+			if !m.Truncated {
+				s.cacheInsert(q, do, tcp, m, subnet)
+			}
+			return
+		}
+		time.Sleep(staleRetry)
+		if m, _ := s.cacheStale(q, dnssec, tcp, req.Id, subnet); m == nil {
+			// answered by the nameservers since, or too old
+			return
+		}
+	}
+}
+
+// refreshWriter stands in for the client of a query that is resolved again in
+// the background. The answer is cached, not written.
+type refreshWriter struct {
+	local, remote net.Addr
+}
+
+func (w *refreshWriter) LocalAddr() net.Addr         { return w.local }
+func (w *refreshWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *refreshWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (w *refreshWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *refreshWriter) Close() error                { return nil }
+func (w *refreshWriter) TsigStatus() error           { return nil }
+func (w *refreshWriter) TsigTimersOnly(bool)         {}
+func (w *refreshWriter) Hijack()                     {}
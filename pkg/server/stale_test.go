@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeStale(t *testing.T) {
+	// The first refresh must not wait for staleRetry.
+	defer func(d time.Duration) { staleRetry = d }(staleRetry)
+	staleRetry = time.Hour
+
+	// The nameserver fails the next fails queries and answers the others
+	// with 192.0.2.<last>.
+	var fails, last int32 = 0, 1
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+				A:   net.IPv4(192, 0, 2, byte(atomic.LoadInt32(&last))),
+			}}
+		}
+		w.WriteMsg(m)
+	}))
+
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	newServer := func(stale time.Duration) *Server {
+		return New(hostfile, &Config{
+			Nameservers: []string{upstream},
+			RCache:      10,
+			RCacheTtl:   time.Minute,
+			ServeStale:  stale,
+			ReadTimeout: time.Second,
+			Attempts:    1,
+		}, "", nil)
+	}
+	query := func(s *Server) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("stale.test.", dns.TypeA)
+		w := NewWriter("udp", "127.0.0.1:0")
+		s.ServeDNS(w, req)
+		return w.Msg()
+	}
+	s, noStale := newServer(time.Hour), newServer(0)
+	for _, s := range []*Server{s, noStale} {
+		m := query(s)
+		if assert.Len(t, m.Answer, 1) {
+			assert.Equal(t, "192.0.2.1", m.Answer[0].(*dns.A).A.String())
+		}
+	}
+
+	// Once the cached answer expired and the nameserver fails, it is served
+	// stale.
+	atomic.StoreInt32(&fails, 2)
+	atomic.StoreInt32(&last, 2)
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, dns.RcodeServerFailure, query(noStale).Rcode)
+	m := query(s)
+	if assert.Equal(t, dns.RcodeSuccess, m.Rcode) && assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", m.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(staleTTL), m.Answer[0].Header().Ttl)
+	}
+
+	// The answer is refreshed in the background right away.
+	q := dns.Question{Name: "stale.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	var cached *dns.Msg
+	for i := 0; i < 50 && cached == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		cached = s.cacheHit(q, false, false, 1, nil)
+	}
+	if assert.NotNil(t, cached) && assert.Len(t, cached.Answer, 1) {
+		assert.Equal(t, "192.0.2.2", cached.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestServeStaleSlow(t *testing.T) {
+	defer func(d time.Duration) { staleAnswerTimeout = d }(staleAnswerTimeout)
+	staleAnswerTimeout = 100 * time.Millisecond
+
+	// The nameserver answers after delay milliseconds with 192.0.2.<n>, n
+	// counting the queries.
+	var delay, n int32
+	upstream := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(time.Duration(atomic.LoadInt32(&delay)) * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+			A:   net.IPv4(192, 0, 2, byte(atomic.AddInt32(&n, 1))),
+		}}
+		w.WriteMsg(m)
+	}))
+
+	hostfile, _ := hosts.NewHostsfile("./golden/hosts.golden", &hosts.Config{Poll: time.Second})
+	s := New(hostfile, &Config{
+		Nameservers: []string{upstream},
+		RCache:      10,
+		RCacheTtl:   time.Minute,
+		ServeStale:  time.Hour,
+		ReadTimeout: time.Second,
+		Attempts:    1,
+	}, "", nil)
+	query := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("slow.test.", dns.TypeA)
+		w := NewWriter("udp", "127.0.0.1:0")
+		s.ServeDNS(w, req)
+		return w.Msg()
+	}
+	query()
+
+	// Once the cached answer expired, a slow nameserver is not waited for.
+	atomic.StoreInt32(&delay, 500)
+	time.Sleep(1100 * time.Millisecond)
+	start := time.Now()
+	m := query()
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", m.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(staleTTL), m.Answer[0].Header().Ttl)
+	}
+
+	// Its answer is cached when it arrives.
+	q := dns.Question{Name: "slow.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	var cached *dns.Msg
+	for i := 0; i < 50 && cached == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		cached = s.cacheHit(q, false, false, 1, nil)
+	}
+	if assert.NotNil(t, cached) && assert.Len(t, cached.Answer, 1) {
+		assert.Equal(t, "192.0.2.2", cached.Answer[0].(*dns.A).A.String())
+	}
+}
@@ -13,17 +13,56 @@ type nopCounter struct{}
 
 func (nopCounter) Inc(_ int64) {}
 
+// Gauge is the metric interface used for values that go up and down
+type Gauge interface {
+	Update(v int64)
+}
+
+type nopGauge struct{}
+
+func (nopGauge) Update(_ int64) {}
+
 var (
-	StatsForwardCount     Counter = nopCounter{}
-	StatsStubForwardCount Counter = nopCounter{}
-	StatsLookupCount      Counter = nopCounter{}
-	StatsRequestCount     Counter = nopCounter{}
-	StatsDnssecOkCount    Counter = nopCounter{}
-	StatsNameErrorCount   Counter = nopCounter{}
-	StatsNoDataCount      Counter = nopCounter{}
-
-	StatsDnssecCacheMiss Counter = nopCounter{}
-
-	StatsCacheMiss Counter = nopCounter{}
-	StatsCacheHit  Counter = nopCounter{}
+	StatsForwardCount        Counter = nopCounter{}
+	StatsStubForwardCount    Counter = nopCounter{}
+	StatsLookupCount         Counter = nopCounter{}
+	StatsCoalescedCount      Counter = nopCounter{}
+	StatsTruncatedRetryCount Counter = nopCounter{}
+	StatsRebindBlockedCount  Counter = nopCounter{}
+	StatsFailoverCount       Counter = nopCounter{}
+	StatsShadowCount         Counter = nopCounter{}
+	StatsShadowDiffCount     Counter = nopCounter{}
+	StatsShadowFailureCount  Counter = nopCounter{}
+	StatsCookieValidCount    Counter = nopCounter{}
+	StatsCookieInvalidCount  Counter = nopCounter{}
+	StatsCookieMismatchCount Counter = nopCounter{}
+	StatsRateLimitedCount    Counter = nopCounter{}
+	StatsCaseMismatchCount   Counter = nopCounter{}
+	StatsDNS64Count          Counter = nopCounter{}
+	StatsRequestCount        Counter = nopCounter{}
+	StatsDnssecOkCount       Counter = nopCounter{}
+	StatsNameErrorCount      Counter = nopCounter{}
+	StatsNoDataCount         Counter = nopCounter{}
+
+	StatsDnssecCacheMiss     Counter = nopCounter{}
+	StatsDnssecSecureCount   Counter = nopCounter{}
+	StatsDnssecInsecureCount Counter = nopCounter{}
+	StatsDnssecBogusCount    Counter = nopCounter{}
+
+	StatsCacheMiss  Counter = nopCounter{}
+	StatsCacheHit   Counter = nopCounter{}
+	StatsStaleCount Counter = nopCounter{}
+
+	StatsPrefetchCount Counter = nopCounter{}
+
+	StatsUpstreamFailureCount Counter = nopCounter{}
+	StatsUpstreamProbeCount   Counter = nopCounter{}
+	StatsUnhealthyUpstreams   Gauge   = nopGauge{}
+
+	StatsUpstreamConnDialCount  Counter = nopCounter{}
+	StatsUpstreamConnReuseCount Counter = nopCounter{}
+
+	// NewUpstreamGauge returns the gauge reporting whether the nameserver
+	// ns is healthy (1) or down (0).
+	NewUpstreamGauge = func(ns string) Gauge { return nopGauge{} }
 )
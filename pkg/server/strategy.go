@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategies for picking the nameserver a query is sent to first.
+const (
+	StrategyStrictOrder = "strict-order" // always start with the first nameserver
+	StrategyRoundRobin  = "round-robin"  // rotate the first nameserver
+	StrategyRandom      = "random"       // try nameservers in random order
+	StrategyFastest     = "fastest"      // start with the lowest average latency
+	StrategyAllServers  = "all-servers"  // query all nameservers, first good answer wins
+)
+
+var upstreamStrategies = []string{
+	StrategyStrictOrder, StrategyRoundRobin, StrategyRandom, StrategyFastest, StrategyAllServers,
+}
+
+// orderUpstreams returns nservers in the order they should be tried.
+func (s *Server) orderUpstreams(nservers []string) []string {
+	ordered := make([]string, len(nservers))
+	copy(ordered, nservers)
+	if len(ordered) < 2 {
+		return ordered
+	}
+
+	switch s.config.UpstreamStrategy {
+	case StrategyRoundRobin:
+		i := int(atomic.AddUint32(&s.rrIndex, 1) % uint32(len(ordered)))
+		ordered = append(ordered[i:], ordered[:i]...)
+	case StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case StrategyFastest:
+		latencies := s.health.latencies(ordered)
+		sort.SliceStable(ordered, func(i, j int) bool { return latencies[ordered[i]] < latencies[ordered[j]] })
+	}
+	return ordered
+}
+
+// forwardAll sends req to all nameservers at the same time and returns the
+// first answer that does not call for a retry. If there is none, the last
+// answer or error is returned.
+func (s *Server) forwardAll(ctx context.Context, req *dns.Msg, nservers []string, tcp bool) (*dns.Msg, error) {
+	type result struct {
+		r   *dns.Msg
+		err error
+	}
+	results := make(chan result, len(nservers))
+	for _, ns := range nservers {
+		go func(ns string, req *dns.Msg) {
+			start := time.Now()
+			r, err := s.exchange(ctx, req, ns, tcp)
+			s.recordHealth(ctx, ns, time.Since(start), err)
+			if err != nil {
+				log.Printf("D! [%d] Failed to query upstream %s for qname '%s': %v",
+					req.Id, ns, req.Question[0].Name, err)
+			}
+			results <- result{r, err}
+		}(ns, req.Copy())
+	}
+
+	var last result
+	for range nservers {
+		res := <-results
+		if res.err == nil && isFinalRcode(res.r.Rcode) {
+			return res.r, nil
+		}
+		if last.r == nil {
+			last = res
+		}
+	}
+	return last.r, last.err
+}
+
+// isFinalRcode reports whether an answer with rcode is passed on to the
+// client rather than retried with another nameserver.
+func isFinalRcode(rcode int) bool {
+	switch rcode {
+	// SUCCESS
+	case dns.RcodeSuccess, dns.RcodeNameError,
+		// NO RECOVERY
+		dns.RcodeFormatError, dns.RcodeRefused, dns.RcodeNotImplemented:
+		return true
+	}
+	return false
+}
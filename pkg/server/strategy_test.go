@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderUpstreams(t *testing.T) {
+	nservers := []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"}
+
+	s := New(nil, &Config{UpstreamStrategy: StrategyStrictOrder}, "", nil)
+	assert.Equal(t, nservers, s.orderUpstreams(nservers))
+
+	s = New(nil, &Config{UpstreamStrategy: StrategyRoundRobin}, "", nil)
+	firsts := map[string]bool{}
+	for i := 0; i < len(nservers); i++ {
+		firsts[s.orderUpstreams(nservers)[0]] = true
+	}
+	assert.Len(t, firsts, len(nservers))
+
+	s = New(nil, &Config{UpstreamStrategy: StrategyRandom}, "", nil)
+	assert.ElementsMatch(t, nservers, s.orderUpstreams(nservers))
+
+	s = New(nil, &Config{UpstreamStrategy: StrategyFastest}, "", nil)
+	s.health.record(nservers[0], 30*time.Millisecond, nil)
+	s.health.record(nservers[1], 10*time.Millisecond, nil)
+	s.health.record(nservers[2], 20*time.Millisecond, nil)
+	assert.Equal(t, []string{nservers[1], nservers[2], nservers[0]}, s.orderUpstreams(nservers))
+
+	// The configured order is never changed.
+	assert.Equal(t, []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"}, nservers)
+}
+
+func TestForwardAllServers(t *testing.T) {
+	slow := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(500 * time.Millisecond)
+		answerA("10.0.0.5")(w, req)
+	}))
+	failing := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	}))
+	fast := startUDPServer(t, "127.0.0.1:0", answerA("10.0.0.6"))
+
+	s := New(nil, &Config{
+		Nameservers:      []string{slow, failing, fast},
+		UpstreamStrategy: StrategyAllServers,
+		ReadTimeout:      time.Second,
+	}, "", nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	r, err := s.forwardQuery(context.Background(), req, false)
+	if assert.NoError(t, err) && assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, "10.0.0.6", r.Answer[0].(*dns.A).A.String())
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
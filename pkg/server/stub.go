@@ -0,0 +1,83 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// StubDefault as the only nameserver of a stub zone sends queries for the zone
+// to the default nameservers, e.g. to exempt a subdomain from a stub zone.
+// A stub zone without any nameservers is resolved locally and never forwarded.
+const StubDefault = "#"
+
+// stubNode is a node of the label-aware trie of stub zones. Each node stands
+// for one label, its children for the labels to the left of it.
+type stubNode struct {
+	children map[string]*stubNode
+	zone     string // name of the stub zone ending at this node, if any
+	servers  []string
+}
+
+// newStubTrie builds the trie of the stub zones in maps. A zone in a later
+// map replaces the same zone in an earlier one.
+func newStubTrie(maps ...map[string][]string) *stubNode {
+	root := &stubNode{}
+	for _, stubs := range maps {
+		for zone, servers := range stubs {
+			root.insert(zone, servers)
+		}
+	}
+	return root
+}
+
+// insert adds the stub zone with its nameservers to the trie.
+func (t *stubNode) insert(zone string, servers []string) {
+	n := t
+	labels := dns.SplitDomainName(strings.ToLower(zone))
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &stubNode{}
+			if n.children == nil {
+				n.children = make(map[string]*stubNode)
+			}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	n.zone = dns.Fqdn(zone)
+	n.servers = servers
+}
+
+// lookup returns the most specific stub zone name belongs to together with
+// its nameservers. ok is false if name is not in any stub zone.
+func (t *stubNode) lookup(name string) (zone string, servers []string, ok bool) {
+	if t == nil {
+		return "", nil, false
+	}
+	n := t
+	if n.zone != "" {
+		zone, servers, ok = n.zone, n.servers, true
+	}
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n = n.children[labels[i]]; n == nil {
+			break
+		}
+		if n.zone != "" {
+			zone, servers, ok = n.zone, n.servers, true
+		}
+	}
+	return zone, servers, ok
+}
+
+// domainSet turns domains into zones without nameservers, for a trie that
+// is only used to tell whether a name belongs to one of them.
+func domainSet(domains []string) map[string][]string {
+	set := make(map[string][]string, len(domains))
+	for _, domain := range domains {
+		set[dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))] = []string{}
+	}
+	return set
+}
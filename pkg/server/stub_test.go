@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateStubMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		zones   []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:  "nameservers",
+			zones: []string{"example.com,Example.org/10.0.0.1,tls://10.0.0.2"},
+			want: map[string][]string{
+				"example.com.": {"10.0.0.1:53", "tls://10.0.0.2:853"},
+				"example.org.": {"10.0.0.1:53", "tls://10.0.0.2:853"},
+			},
+		},
+		{
+			name:  "dnsmasq syntax with exceptions",
+			zones: []string{"/example.com/10.0.0.1", "/corp.example.com/#", "/local.lan/"},
+			want: map[string][]string{
+				"example.com.":      {"10.0.0.1:53"},
+				"corp.example.com.": {StubDefault},
+				"local.lan.":        {},
+			},
+		},
+		{name: "no domain", zones: []string{"/10.0.0.1"}, wantErr: true},
+		{name: "bad domain", zones: []string{"exa..mple.com/10.0.0.1"}, wantErr: true},
+		{name: "bad nameserver", zones: []string{"example.com/example.net"}, wantErr: true},
+		{name: "conflicting exception", zones: []string{"example.com/10.0.0.1", "example.com/#"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := CreateStubMap(tc.zones)
+		if tc.wantErr {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.want, got, tc.name)
+		}
+	}
+}
+
+func TestStubLookup(t *testing.T) {
+	stubs, err := CreateStubMap([]string{
+		"example.com/10.0.0.1",
+		"sub.example.com/10.0.0.2",
+		"corp.example.com/#",
+		"local.lan/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trie := newStubTrie(stubs)
+
+	tests := []struct {
+		name     string
+		wantZone string
+	}{
+		{name: "example.com.", wantZone: "example.com."},
+		{name: "www.example.com.", wantZone: "example.com."},
+		{name: "www.SUB.example.com.", wantZone: "sub.example.com."},
+		{name: "host.corp.example.com.", wantZone: "corp.example.com."},
+		{name: "printer.local.lan.", wantZone: "local.lan."},
+		{name: "badexample.com.", wantZone: ""},
+		{name: "com.", wantZone: ""},
+	}
+	for _, tc := range tests {
+		zone, servers, ok := trie.lookup(tc.name)
+		assert.Equal(t, tc.wantZone, zone, tc.name)
+		assert.Equal(t, tc.wantZone != "", ok, tc.name)
+		if ok {
+			assert.Equal(t, stubs[zone], servers, tc.name)
+		}
+	}
+}
+
+func TestForwardStubExceptions(t *testing.T) {
+	def := startUDPServer(t, "127.0.0.1:0", answerA("10.0.0.7"))
+	stub := startUDPServer(t, "127.0.0.1:0", answerA("10.0.0.8"))
+	stubs, err := CreateStubMap([]string{"example.com/" + stub, "corp.example.com/#", "local.lan/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(nil, &Config{Nameservers: []string{def}, Stub: stubs}, "", nil)
+
+	tests := []struct {
+		name      string
+		wantRcode int
+		wantA     string
+	}{
+		{name: "www.example.com.", wantA: "10.0.0.8"},
+		{name: "www.corp.example.com.", wantA: "10.0.0.7"},
+		{name: "www.badexample.com.", wantA: "10.0.0.7"},
+		{name: "printer.local.lan.", wantRcode: dns.RcodeNameError},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		assert.Equal(t, tc.wantRcode, r.Rcode, tc.name)
+		if tc.wantA != "" && assert.Len(t, r.Answer, 1, tc.name) {
+			assert.Equal(t, tc.wantA, r.Answer[0].(*dns.A).A.String(), tc.name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// exchangeTLS sends req to a DNS-over-TLS nameserver over a pooled connection.
+func (s *Server) exchangeTLS(ctx context.Context, req *dns.Msg, u upstream) (*dns.Msg, error) {
+	return s.pool.exchange(ctx, req, protoTLS+"|"+u.addr+"#"+u.serverName, func() (*dns.Conn, error) {
+		client := *s.dnsTLSClient
+		client.TLSConfig = s.dnsTLSClient.TLSConfig.Clone()
+		client.TLSConfig.ServerName = u.serverName
+		if client.TLSConfig.ServerName == "" {
+			// Without a name the certificate must be issued for the IP address.
+			client.TLSConfig.ServerName, _, _ = net.SplitHostPort(u.addr)
+		}
+		return client.DialContext(ctx, u.addr)
+	})
+}
+
+// newTLSConfig returns the TLS configuration used for DNS-over-TLS nameservers.
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if caFile != "" {
+		pool, err := loadRootCAs(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// loadRootCAs reads a PEM bundle of CA certificates.
+func loadRootCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCert returns a self-signed certificate for 127.0.0.1 and dnsName
+// together with the path of a CA file that trusts it.
+func newTestCert(t *testing.T, dnsName string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{dnsName},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func answerA(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		}}
+		w.WriteMsg(m)
+	}
+}
+
+func TestForwardTLS(t *testing.T) {
+	cert, caFile := newTestCert(t, "dns.test")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	srv := &dns.Server{Listener: cl, Handler: answerA("10.0.0.1")}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	addr := l.Addr().String()
+	tests := []struct {
+		name       string
+		nameserver string
+		wantErr    bool
+	}{
+		{name: "verify server name", nameserver: "tls://" + addr + "#dns.test"},
+		{name: "verify ip address", nameserver: "tls://" + addr},
+		{name: "wrong server name", nameserver: "tls://" + addr + "#other.test", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		nameservers, err := CreateNameservers([]string{tc.nameserver})
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		s := New(nil, &Config{Nameservers: nameservers, TLSCAFile: caFile, ReadTimeout: time.Second}, "", nil)
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		r, err := s.forwardQuery(context.Background(), req, false)
+		if tc.wantErr {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		if assert.NoError(t, err, tc.name) && assert.Len(t, r.Answer, 1, tc.name) {
+			assert.Equal(t, "10.0.0.1", r.Answer[0].(*dns.A).A.String(), tc.name)
+		}
+	}
+
+	// Queries through the same server reuse the open connection.
+	s := New(nil, &Config{Nameservers: []string{"tls://" + addr + "#dns.test"}, TLSCAFile: caFile, ReadTimeout: time.Second}, "", nil)
+	before := atomic.LoadInt32(&cl.accepted)
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, err := s.forwardQuery(context.Background(), req, false)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cl.accepted)-before)
+}
+
+func TestCreateNameservers(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "8.8.8.8", want: "8.8.8.8:53"},
+		{in: "[::1]", want: "[::1]:53"},
+		{in: "tls://1.1.1.1#cloudflare-dns.com", want: "tls://1.1.1.1:853#cloudflare-dns.com"},
+		{in: "tls://1.1.1.1:8853", want: "tls://1.1.1.1:8853"},
+		{in: "tls://dns.google", wantErr: true},
+		{in: "tls://1.1.1.1#bad..name", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := CreateNameservers([]string{tc.in})
+		if tc.wantErr {
+			assert.Error(t, err, tc.in)
+			continue
+		}
+		if assert.NoError(t, err, tc.in) {
+			assert.Equal(t, []string{tc.want}, got, tc.in)
+		}
+	}
+}
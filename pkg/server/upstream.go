@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	tlsPrefix   = "tls://"
+	httpsPrefix = "https://"
+)
+
+const (
+	protoDNS      = "dns"      // plain DNS over UDP or TCP
+	protoTLS      = "tls"      // DNS-over-TLS (RFC 7858)
+	protoHTTPS    = "https"    // DNS-over-HTTPS (RFC 8484)
+	protoDNSCrypt = "dnscrypt" // DNSCrypt version 2, configured with a stamp
+)
+
+// upstream describes a nameserver that queries are forwarded to.
+type upstream struct {
+	proto      string
+	addr       string // ip:port to connect to, for HTTPS upstreams only set to bypass name resolution
+	serverName string // name used to verify the certificate of TLS upstreams
+	url        string // URL of HTTPS upstreams
+}
+
+// parseUpstream splits a nameserver as created by CreateNameservers into its parts.
+func parseUpstream(ns string) upstream {
+	if rest, ok := strings.CutPrefix(ns, tlsPrefix); ok {
+		addr, serverName, _ := strings.Cut(rest, "#")
+		return upstream{proto: protoTLS, addr: addr, serverName: serverName}
+	}
+	if strings.HasPrefix(ns, dnscryptPrefix) {
+		return upstream{proto: protoDNSCrypt}
+	}
+	if strings.HasPrefix(ns, httpsPrefix) {
+		rawURL, bootstrap, _ := strings.Cut(ns, "#")
+		u := upstream{proto: protoHTTPS, url: rawURL}
+		if bootstrap != "" {
+			if parsed, err := url.Parse(rawURL); err == nil {
+				port := parsed.Port()
+				if port == "" {
+					port = "443"
+				}
+				u.addr = net.JoinHostPort(bootstrap, port)
+			}
+		}
+		return u
+	}
+	return upstream{proto: protoDNS, addr: ns}
+}
+
+// exchange sends req to the nameserver ns using the transport ns asks for.
+// Plain nameservers are queried over the transport the client used, and
+// again over TCP if their UDP response is truncated. With cookies enabled,
+// queries to them carry a cookie and are retried once on BADCOOKIE.
+func (s *Server) exchange(ctx context.Context, req *dns.Msg, ns string, tcp bool) (*dns.Msg, error) {
+	u := parseUpstream(ns)
+	switch {
+	case u.proto == protoTLS:
+		return s.exchangeTLS(ctx, req, u)
+	case u.proto == protoHTTPS:
+		return s.exchangeHTTPS(ctx, req, ns, u)
+	case u.proto == protoDNSCrypt:
+		return s.exchangeDNSCrypt(ctx, req, ns, tcp)
+	case s.cookies == nil:
+		return s.exchangeDNS(ctx, req, ns, u, tcp)
+	}
+
+	for try := 0; ; try++ {
+		r, err := s.exchangeDNS(ctx, s.cookies.request(u.addr, req), ns, u, tcp)
+		if err == nil {
+			err = s.cookies.response(u.addr, r)
+		}
+		if err != nil || r.Rcode != dns.RcodeBadCookie || try == maxCookieRetries {
+			return r, err
+		}
+		log.Printf("D! [%d] Upstream %s answered BADCOOKIE, retrying with its server cookie", req.Id, ns)
+	}
+}
+
+// exchangeDNS sends req to the plain DNS nameserver ns. With RandomizeCase,
+// UDP responses must echo the random case of the query name.
+func (s *Server) exchangeDNS(ctx context.Context, req *dns.Msg, ns string, u upstream, tcp bool) (*dns.Msg, error) {
+	switch {
+	case tcp:
+		return s.pool.exchange(ctx, req, "tcp|"+u.addr, func() (*dns.Conn, error) {
+			return s.dnsTCPClient.DialContext(ctx, u.addr)
+		})
+	default:
+		up := req
+		if s.config.RandomizeCase {
+			up = randomizeCase(req)
+		}
+		r, _, err := s.dnsUDPClient.ExchangeContext(ctx, up, u.addr)
+		if err == nil && up != req {
+			err = restoreCase(req, up, r)
+		}
+		if err == nil && r.Truncated {
+			// Get the whole answer, Fit makes it fit the client's buffer.
+			log.Printf("D! [%d] Truncated response from upstream %s, retrying over TCP", req.Id, ns)
+			StatsTruncatedRetryCount.Inc(1)
+			full, tcpErr := s.exchangeDNS(ctx, req, ns, u, true)
+			if tcpErr == nil {
+				return full, nil
+			}
+			log.Printf("D! [%d] Failed to retry query over TCP with upstream %s: %v", req.Id, ns, tcpErr)
+		}
+		return r, err
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/soulteary/go-dnsmasq/pkg/cache"
+	hosts "github.com/soulteary/go-dnsmasq/pkg/hostsfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncatedRetryOverTCP(t *testing.T) {
+	const records = 50
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+		for i := 0; i < records; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(fmt.Sprintf("10.0.1.%d", i)),
+			})
+		}
+		w.WriteMsg(m)
+	})
+	addr := startUDPServer(t, "127.0.0.1:0", handler)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s over TCP: %v", addr, err)
+	}
+	tcpSrv := &dns.Server{Listener: l, Handler: handler}
+	go tcpSrv.ActivateAndServe()
+	defer tcpSrv.Shutdown()
+
+	hostfile, _ := hosts.NewHostsfile("", &hosts.Config{})
+	s := New(hostfile, &Config{
+		Nameservers: []string{addr},
+		ReadTimeout: time.Second,
+		RCache:      10,
+		RCacheTtl:   time.Minute,
+	}, "", nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rw := NewWriter("udp", "127.0.0.1:0")
+	s.ServeDNS(rw, req)
+
+	// The client gets what fits into 512 bytes...
+	m := rw.Msg()
+	assert.True(t, m.Truncated)
+	assert.Less(t, m.Len(), 512)
+	assert.NotEmpty(t, m.Answer)
+
+	// ...while the cache holds the whole answer.
+	cached, _, ok := s.rcache.Search(cache.Key(req.Question[0], false, false))
+	if assert.True(t, ok) {
+		assert.False(t, cached.Truncated)
+		assert.Len(t, cached.Answer, records)
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	var requests int32
+	var sent atomic.Value
+	echo := startUDPServer(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		sent.Store(req.Question[0].Name)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("10.0.0.1"),
+		}}
+		w.WriteMsg(m)
+	}))
+	// lower answers with the query name in lower case, like a spoofer that
+	// cannot see the query would.
+	lower := startUDPServer(t, "127.0.0.1:0", countQueries(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+		w.WriteMsg(m)
+	}, &requests))
+
+	const name = "a-long-name-with-many-letters.Example.COM."
+	s := New(nil, &Config{Nameservers: []string{echo}, RandomizeCase: true, ReadTimeout: time.Second}, "", nil)
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	r, err := s.forwardQuery(context.Background(), req, false)
+	if assert.NoError(t, err) && assert.Len(t, r.Answer, 1) {
+		assert.Equal(t, name, r.Question[0].Name)
+		assert.Equal(t, name, r.Answer[0].Header().Name)
+	}
+	assert.True(t, strings.EqualFold(name, sent.Load().(string)))
+	assert.NotEqual(t, name, sent.Load().(string))
+
+	s = New(nil, &Config{Nameservers: []string{lower}, RandomizeCase: true, Attempts: 2, ReadTimeout: time.Second}, "", nil)
+	_, err = s.forwardQuery(context.Background(), req, false)
+	assert.ErrorIs(t, err, errCaseMismatch)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -10,9 +10,11 @@ package stats
 import (
 	"net"
 	"os"
+	"strings"
 
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/rcrowley/go-metrics/stathat"
+	"github.com/soulteary/go-dnsmasq/pkg/cache"
 	"github.com/soulteary/go-dnsmasq/pkg/server"
 )
 
@@ -33,12 +35,60 @@ func init() {
 	server.StatsStubForwardCount = metrics.NewCounter()
 	metrics.Register("go-dnsmaq-stub-forward-requests", server.StatsStubForwardCount)
 
+	server.StatsCoalescedCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-coalesced-requests", server.StatsCoalescedCount)
+
+	server.StatsTruncatedRetryCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-truncated-retries", server.StatsTruncatedRetryCount)
+
+	server.StatsRebindBlockedCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-rebind-blocked", server.StatsRebindBlockedCount)
+
+	server.StatsFailoverCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-failovers", server.StatsFailoverCount)
+
+	server.StatsShadowCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-shadow-queries", server.StatsShadowCount)
+
+	server.StatsShadowDiffCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-shadow-differences", server.StatsShadowDiffCount)
+
+	server.StatsShadowFailureCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-shadow-failures", server.StatsShadowFailureCount)
+
+	server.StatsCookieValidCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-cookies-valid", server.StatsCookieValidCount)
+
+	server.StatsCookieInvalidCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-cookies-invalid", server.StatsCookieInvalidCount)
+
+	server.StatsCookieMismatchCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-upstream-cookie-mismatches", server.StatsCookieMismatchCount)
+
+	server.StatsRateLimitedCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-rate-limited", server.StatsRateLimitedCount)
+
+	server.StatsCaseMismatchCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-upstream-case-mismatches", server.StatsCaseMismatchCount)
+
+	server.StatsDNS64Count = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-dns64-synthesized", server.StatsDNS64Count)
+
 	server.StatsDnssecOkCount = metrics.NewCounter()
 	metrics.Register("go-dnsmaq-dnssecok-requests", server.StatsDnssecOkCount)
 
 	server.StatsDnssecCacheMiss = metrics.NewCounter()
 	metrics.Register("go-dnsmaq-dnssec-cache-miss", server.StatsDnssecCacheMiss)
 
+	server.StatsDnssecSecureCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-dnssec-secure", server.StatsDnssecSecureCount)
+
+	server.StatsDnssecInsecureCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-dnssec-insecure", server.StatsDnssecInsecureCount)
+
+	server.StatsDnssecBogusCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-dnssec-bogus", server.StatsDnssecBogusCount)
+
 	server.StatsLookupCount = metrics.NewCounter()
 	metrics.Register("go-dnsmaq-internal-lookups", server.StatsLookupCount)
 
@@ -51,11 +101,66 @@ func init() {
 	server.StatsNoDataCount = metrics.NewCounter()
 	metrics.Register("go-dnsmaq-nodata-responses", server.StatsNoDataCount)
 
-	server.StatsCacheMiss = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-nodata-responses", server.StatsCacheMiss)
+	cacheMiss := metrics.NewCounter()
+	server.StatsCacheMiss = cacheMiss
+	metrics.Register("go-dnsmaq-cache-misses", cacheMiss)
+
+	cacheHit := metrics.NewCounter()
+	server.StatsCacheHit = cacheHit
+	metrics.Register("go-dnsmaq-cache-hits", cacheHit)
 
-	server.StatsCacheHit = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-nodata-responses", server.StatsCacheHit)
+	metrics.Register("go-dnsmaq-cache-hit-ratio", metrics.NewFunctionalGaugeFloat64(func() float64 {
+		hits, total := cacheHit.Count(), cacheHit.Count()+cacheMiss.Count()
+		if total == 0 {
+			return 0
+		}
+		return float64(hits) / float64(total)
+	}))
+
+	server.StatsStaleCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-stale-responses", server.StatsStaleCount)
+
+	server.StatsPrefetchCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-prefetches", server.StatsPrefetchCount)
+
+	cache.StatsPrefetchHitCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-prefetch-hits", cache.StatsPrefetchHitCount)
+
+	cache.StatsInsertCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-cache-insertions", cache.StatsInsertCount)
+
+	cache.StatsEvictionCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-cache-evictions", cache.StatsEvictionCount)
+
+	server.StatsUpstreamFailureCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-upstream-failures", server.StatsUpstreamFailureCount)
+
+	server.StatsUpstreamProbeCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-upstream-probes", server.StatsUpstreamProbeCount)
+
+	server.StatsUnhealthyUpstreams = metrics.NewGauge()
+	metrics.Register("go-dnsmaq-upstreams-down", server.StatsUnhealthyUpstreams)
+
+	server.StatsUpstreamConnDialCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-upstream-conn-dials", server.StatsUpstreamConnDialCount)
+
+	server.StatsUpstreamConnReuseCount = metrics.NewCounter()
+	metrics.Register("go-dnsmaq-upstream-conn-reuses", server.StatsUpstreamConnReuseCount)
+
+	server.NewUpstreamGauge = func(ns string) server.Gauge {
+		return metrics.GetOrRegisterGauge("go-dnsmaq-upstream-healthy."+metricName(ns), metrics.DefaultRegistry)
+	}
+}
+
+// metricName replaces the characters of s that have a meaning in metric paths.
+func metricName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
 }
 
 func Collect() {
@@ -5,7 +5,32 @@ const (
 	Listen                = "DNSMASQ_LISTEN"
 	DefaultResolver       = "DNSMASQ_DEFAULT"
 	NameServers           = "DNSMASQ_SERVERS"
+	FallbackNameServers   = "DNSMASQ_FALLBACK_SERVERS"
+	ShadowNameServer      = "DNSMASQ_SHADOW_SERVER"
+	ShadowPercent         = "DNSMASQ_SHADOW_PERCENT"
+	Recursive             = "DNSMASQ_RECURSIVE"
+	RootHints             = "DNSMASQ_ROOT_HINTS"
+	DNSSEC                = "DNSMASQ_DNSSEC"
+	TrustAnchorFile       = "DNSMASQ_TRUST_ANCHOR_FILE"
+	Cookies               = "DNSMASQ_COOKIES"
+	RandomizeCase         = "DNSMASQ_RANDOMIZE_CASE"
+	TLSCAFile             = "DNSMASQ_TLS_CA_FILE"
+	DoHMethod             = "DNSMASQ_DOH_METHOD"
+	UpstreamStrategy      = "DNSMASQ_UPSTREAM_STRATEGY"
+	ECSMode               = "DNSMASQ_ECS"
+	Timeout               = "DNSMASQ_TIMEOUT"
+	Attempts              = "DNSMASQ_ATTEMPTS"
+	QueryDeadline         = "DNSMASQ_QUERY_DEADLINE"
+	ECSPrefixV4           = "DNSMASQ_ECS_PREFIX_V4"
+	ECSPrefixV6           = "DNSMASQ_ECS_PREFIX_V6"
 	StubZone              = "DNSMASQ_STUB"
+	RevServer             = "DNSMASQ_REV_SERVER"
+	BogusPriv             = "DNSMASQ_BOGUS_PRIV"
+	StopDNSRebind         = "DNSMASQ_STOP_DNS_REBIND"
+	RebindDomainOK        = "DNSMASQ_REBIND_DOMAIN_OK"
+	DNS64                 = "DNSMASQ_DNS64"
+	DNS64Prefix           = "DNSMASQ_DNS64_PREFIX"
+	DNS64Exclude          = "DNSMASQ_DNS64_EXCLUDE"
 	HostsFile             = "DNSMASQ_HOSTSFILE"
 	HostsDirectory        = "DNSMASQ_DIRECTORY_HOSTSFILES"
 	HostsFilePollDuration = "DNSMASQ_POLL"
@@ -13,6 +38,14 @@ const (
 	EnableSearch          = "DNSMASQ_ENABLE_SEARCH"
 	ResponseCacheCap      = "DNSMASQ_RCACHE"
 	ResponseCacheTTL      = "DNSMASQ_RCACHE_TTL"
+	ResponseCacheMinTTL   = "DNSMASQ_RCACHE_MIN_TTL"
+	ResponseCacheMaxTTL   = "DNSMASQ_RCACHE_MAX_TTL"
+	NegativeCacheTTL      = "DNSMASQ_NEG_CACHE_TTL"
+	ServeStale            = "DNSMASQ_SERVE_STALE"
+	Prefetch              = "DNSMASQ_PREFETCH"
+	PrefetchHits          = "DNSMASQ_PREFETCH_HITS"
+	PrefetchPercent       = "DNSMASQ_PREFETCH_PERCENT"
+	PrefetchConcurrency   = "DNSMASQ_PREFETCH_CONCURRENCY"
 	DisableRecursion      = "DNSMASQ_NOREC"
 	FwdNdots              = "DNSMASQ_FWD_NDOTS"
 	Ndots                 = "DNSMASQ_NDOTS"